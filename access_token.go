@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const accessTokenPrefix = "chirpy_pat_"
+
+// AccessToken is a personal access token a user creates for bots and
+// scripts. Only the SHA-256 of the token is stored; the token itself is
+// returned once, when it's created.
+type AccessToken struct {
+	ID		string		`json:"id"`
+	UserID		int		`json:"user_id"`
+	Name		string		`json:"name"`
+	Scopes		[]string	`json:"scopes"`
+	CreatedAt	time.Time	`json:"created_at"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+}
+
+type AccessTokenCredential struct {
+	AccessToken
+	TokenHash string `json:"token_hash"`
+}
+
+func (db *DB) CreateAccessToken(userID int, name string, scopes []string, expiresAt *time.Time) (AccessToken, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	tokenString := accessTokenPrefix + secret
+
+	token := AccessTokenCredential{
+		AccessToken: AccessToken{
+			ID: id,
+			UserID: userID,
+			Name: name,
+			Scopes: scopes,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		},
+		TokenHash: hashAccessToken(tokenString),
+	}
+	err = db.update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[userID]; !ok {
+			return errors.New("user not found")
+		}
+		dbs.AccessTokens[token.ID] = token
+		return nil
+	})
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	return token.AccessToken, tokenString, nil
+}
+
+func (db *DB) GetAccessTokens(userID int) ([]AccessToken, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return []AccessToken{}, err
+	}
+	tokens := []AccessToken{}
+	for _, token := range dbs.AccessTokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token.AccessToken)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (db *DB) RevokeAccessToken(userID int, tokenID string) error {
+	return db.update(func(dbs *DBStructure) error {
+		token, ok := dbs.AccessTokens[tokenID]
+		if !ok || token.UserID != userID {
+			return errors.New("token not found")
+		}
+		delete(dbs.AccessTokens, tokenID)
+		return nil
+	})
+}
+
+// UseAccessToken looks up a presented token, rejects it if it has expired
+// and records when it was last used.
+func (db *DB) UseAccessToken(tokenString string) (AccessToken, error) {
+	hash := hashAccessToken(tokenString)
+	var found AccessToken
+	err := db.update(func(dbs *DBStructure) error {
+		for id, token := range dbs.AccessTokens {
+			if token.TokenHash != hash {
+				continue
+			}
+			now := time.Now().UTC()
+			if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+				return errors.New("token expired")
+			}
+			token.LastUsedAt = &now
+			dbs.AccessTokens[id] = token
+			found = token.AccessToken
+			return nil
+		}
+		return errors.New("token not found")
+	})
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return found, nil
+}
+
+func isAccessToken(tokenString string) bool {
+	return strings.HasPrefix(tokenString, accessTokenPrefix)
+}
+
+func hashAccessToken(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	randBytes := make([]byte, n)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randBytes), nil
+}
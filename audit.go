@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditSuccess	= "success"
+	auditFailure	= "failure"
+	// Unauthenticated failures are recorded at most once per window for
+	// each action, target and IP, for at most maxThrottledAuditKeys keys
+	// at a time.
+	failureAuditWindow	= time.Minute
+	maxThrottledAuditKeys	= 10000
+)
+
+// AuditEvent is one entry in the security audit log. ActorID is 0 when the
+// actor is unknown (a failed login) or external (a payment webhook).
+type AuditEvent struct {
+	ID		int			`json:"id"`
+	Time		time.Time		`json:"time"`
+	ActorID		int			`json:"actor_id"`
+	Action		string			`json:"action"`
+	Target		string			`json:"target"`
+	IP		string			`json:"ip,omitempty"`
+	UserAgent	string			`json:"user_agent,omitempty"`
+	Outcome		string			`json:"outcome"`
+	Details		map[string]string	`json:"details,omitempty"`
+}
+
+type AuditFilter struct {
+	ActorID	int
+	Action	string
+	Target	string
+	Outcome	string
+	Since	time.Time
+	Until	time.Time
+	Limit	int
+	Offset	int
+}
+
+// newAuditEvent starts an event for an action taken through r.
+func newAuditEvent(r *http.Request, actorID int, action string, target string) AuditEvent {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return AuditEvent{
+		ActorID: actorID,
+		Action: action,
+		Target: target,
+		IP: ip,
+		UserAgent: r.UserAgent(),
+		Outcome: auditSuccess,
+	}
+}
+
+func userTarget(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// audit records an event on its own. Failing to record it is logged but
+// doesn't fail the request.
+func (cfg *apiConfig) audit(event AuditEvent) {
+	err := cfg.db.update(func(dbs *DBStructure) error {
+		dbs.appendAudit(event)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error recording audit event %s: %v", event.Action, err)
+	}
+}
+
+// auditThrottle keeps anonymous clients from growing the audit log, and
+// rewriting the database, with every failed login or refresh. Repeats
+// within the window are only counted, and reported in the details of the
+// next event recorded for the same key.
+type auditThrottle struct {
+	mux	*sync.Mutex
+	keys	map[string]throttledFailures
+}
+
+type throttledFailures struct {
+	recordedAt	time.Time
+	suppressed	int
+}
+
+func newAuditThrottle() *auditThrottle {
+	return &auditThrottle{
+		mux: &sync.Mutex{},
+		keys: map[string]throttledFailures{},
+	}
+}
+
+// auditUnauthenticatedFailure records a failure by an unknown actor,
+// subject to the throttle.
+func (cfg *apiConfig) auditUnauthenticatedFailure(event AuditEvent) {
+	event.Outcome = auditFailure
+	if !cfg.auditThrottle.allow(&event) {
+		return
+	}
+	cfg.audit(event)
+}
+
+// allow reports whether event should be recorded, adding the number of
+// repeats it stands for to its details.
+func (t *auditThrottle) allow(event *AuditEvent) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := time.Now().UTC()
+	key := event.Action + "|" + event.Target + "|" + event.IP
+
+	entry, ok := t.keys[key]
+	if ok && now.Sub(entry.recordedAt) < failureAuditWindow {
+		entry.suppressed++
+		t.keys[key] = entry
+		return false
+	}
+	if !ok && len(t.keys) >= maxThrottledAuditKeys {
+		t.evict(now)
+	}
+	if entry.suppressed > 0 {
+		if event.Details == nil {
+			event.Details = map[string]string{}
+		}
+		event.Details["repeats_suppressed"] = strconv.Itoa(entry.suppressed)
+	}
+	t.keys[key] = throttledFailures{recordedAt: now}
+	return true
+}
+
+// evict makes room for a new key by forgetting keys whose window has
+// passed, or failing that the oldest one. Their suppressed counts are lost.
+func (t *auditThrottle) evict(now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range t.keys {
+		if now.Sub(entry.recordedAt) >= failureAuditWindow {
+			delete(t.keys, key)
+			continue
+		}
+		if oldestKey == "" || entry.recordedAt.Before(oldest) {
+			oldestKey, oldest = key, entry.recordedAt
+		}
+	}
+	if len(t.keys) >= maxThrottledAuditKeys {
+		delete(t.keys, oldestKey)
+	}
+}
+
+// appendAudit records an event as part of the caller's update, so it is
+// only persisted if the change it describes is. Events older than the
+// retention period are dropped at the same time; nothing else ever removes
+// or changes an event.
+func (dbs *DBStructure) appendAudit(event AuditEvent) {
+	event.ID = 1
+	if n := len(dbs.AuditLog); n > 0 {
+		event.ID = dbs.AuditLog[n-1].ID + 1
+	}
+	event.Time = time.Now().UTC()
+	if event.Outcome == "" {
+		event.Outcome = auditSuccess
+	}
+	dbs.AuditLog = append(dbs.AuditLog, event)
+
+	if retention := auditRetention(); retention > 0 {
+		cutoff := event.Time.Add(-retention)
+		keep := sort.Search(len(dbs.AuditLog), func(i int) bool {
+			return !dbs.AuditLog[i].Time.Before(cutoff)
+		})
+		dbs.AuditLog = dbs.AuditLog[keep:]
+	}
+}
+
+// auditRetention reads AUDIT_RETENTION_DAYS; 0 keeps events forever.
+func auditRetention() time.Duration {
+	days := 365
+	if n, err := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS")); err == nil && n >= 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GetAuditEvents returns matching events newest first, along with the total
+// number of matches before pagination.
+func (db *DB) GetAuditEvents(filter AuditFilter) ([]AuditEvent, int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return []AuditEvent{}, 0, err
+	}
+
+	matches := []AuditEvent{}
+	for i := len(dbs.AuditLog) - 1; i >= 0; i-- {
+		event := dbs.AuditLog[i]
+		if filter.ActorID != 0 && event.ActorID != filter.ActorID {
+			continue
+		}
+		if filter.Action != "" && event.Action != filter.Action {
+			continue
+		}
+		if filter.Target != "" && event.Target != filter.Target {
+			continue
+		}
+		if filter.Outcome != "" && event.Outcome != filter.Outcome {
+			continue
+		}
+		if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !event.Time.Before(filter.Until) {
+			continue
+		}
+		matches = append(matches, event)
+	}
+
+	total := len(matches)
+	if filter.Offset >= total {
+		return []AuditEvent{}, total, nil
+	}
+	matches = matches[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matches) {
+		matches = matches[:filter.Limit]
+	}
+	return matches, total, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scopeChirpsRead		= "chirps:read"
+	scopeChirpsWrite	= "chirps:write"
+	scopeUsersRead		= "users:read"
+	scopeUsersWrite		= "users:write"
+	// scopeTokens guards token and client management and is never granted
+	// to personal access tokens or OAuth clients, so a leaked token can't
+	// mint more tokens.
+	scopeTokens		= "tokens"
+	// scopeAdmin is likewise never delegated; the user must also be an
+	// admin.
+	scopeAdmin		= "admin"
+)
+
+// delegatedScopes are the scopes a personal access token or OAuth client
+// may be granted.
+var delegatedScopes = map[string]bool{
+	scopeChirpsRead: true,
+	scopeChirpsWrite: true,
+	scopeUsersRead: true,
+}
+
+// readOnlyScopes are the scopes that never change anything, and the only
+// ones impersonation tokens get unless IMPERSONATION_ALLOW_WRITES is set.
+var readOnlyScopes = map[string]bool{
+	scopeChirpsRead: true,
+	scopeUsersRead: true,
+}
+
+var errInsufficientScope = errors.New("insufficient scope")
+
+// authenticate resolves the user behind the request's Authorization header,
+// which may carry a JWT from /api/login, a JWT issued to an OAuth client or
+// a personal access token, and checks that the credential grants scope.
+// Without the header, the browser session cookie set at login is used. JWTs
+// stop working as soon as the user's token version is bumped.
+func (cfg *apiConfig) authenticate(r *http.Request, scope string) (int, error) {
+	tokenString, err := bearerOrCookie(r, accessCookieName)
+	if err != nil {
+		return 0, err
+	}
+
+	if isAccessToken(tokenString) {
+		token, err := cfg.db.UseAccessToken(tokenString)
+		if err != nil {
+			return 0, err
+		}
+		if !hasScope(token.Scopes, scope) {
+			return 0, errInsufficientScope
+		}
+		_, err = cfg.checkAccount(token.UserID)
+		return token.UserID, err
+	}
+
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, err
+	}
+
+	if claims.ClientID != "" {
+		grant, err := cfg.db.GetOAuthGrant(claims.ID)
+		if err != nil || grant.UserID != userID || grant.ClientID != claims.ClientID {
+			return 0, errors.New("token has been revoked")
+		}
+		if !hasScope(strings.Fields(claims.Scope), scope) {
+			return 0, errInsufficientScope
+		}
+	}
+	if claims.ImpersonatorID != 0 {
+		err = cfg.checkImpersonation(r, claims.ImpersonatorID, userID, scope)
+		if err != nil {
+			return 0, err
+		}
+	}
+	user, err := cfg.checkAccount(userID)
+	if err != nil {
+		return 0, err
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		return 0, errors.New("token has been revoked")
+	}
+	return userID, nil
+}
+
+// checkImpersonation vets and records every request made with an
+// impersonation token: the admin who minted it must still be an admin, and
+// unless IMPERSONATION_ALLOW_WRITES is set only read-only scopes are
+// granted.
+func (cfg *apiConfig) checkImpersonation(r *http.Request, adminID int, userID int, scope string) error {
+	event := newAuditEvent(r, adminID, "impersonation.request", userTarget(userID))
+	event.Details = map[string]string{
+		"method": r.Method,
+		"path": r.URL.Path,
+		"scope": scope,
+	}
+
+	admin, err := cfg.db.GetUser(adminID)
+	if err != nil || !admin.IsAdmin {
+		err = errors.New("impersonation token is no longer valid")
+	} else if !readOnlyScopes[scope] && !envBool("IMPERSONATION_ALLOW_WRITES", false) {
+		err = fmt.Errorf("%w: impersonation tokens are read-only", errInsufficientScope)
+	}
+	if err != nil {
+		event.Outcome = auditFailure
+		event.Details["reason"] = err.Error()
+	}
+	cfg.audit(event)
+	return err
+}
+
+// checkAccount rejects credentials of users who have since been deleted,
+// suspended or banned, and otherwise returns the user.
+func (cfg *apiConfig) checkAccount(userID int) (UserCredential, error) {
+	user, err := cfg.db.GetUserCredential(userID)
+	if err != nil {
+		return UserCredential{}, err
+	}
+	if user.Moderation.blocked(time.Now().UTC()) {
+		return UserCredential{}, user.Moderation.blockedError()
+	}
+	return user, nil
+}
+
+// authenticateAdmin is authenticate for the admin endpoints.
+func (cfg *apiConfig) authenticateAdmin(r *http.Request) (int, error) {
+	userID, err := cfg.authenticate(r, scopeAdmin)
+	if err != nil {
+		return 0, err
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	if !user.IsAdmin {
+		return 0, errInsufficientScope
+	}
+	return userID, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInsufficientScope) || errors.Is(err, errCSRF) || errors.Is(err, errAccountSuspended) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusUnauthorized, "unauthorized")
+}
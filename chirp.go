@@ -1,8 +1,109 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
 type Chirp struct {
 	ID int `json:"id"`
 	Body string `json:"body"`
 	AuthorID int `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Entities ChirpEntities `json:"entities"`
+	// InReplyTo is the chirp this one replies to, if any.
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// ConversationID is the ID of the chirp that started the thread; a
+	// chirp that isn't a reply starts its own.
+	ConversationID int `json:"conversation_id"`
+	ReplyCount int `json:"reply_count"`
+	// A rechirp reposts RechirpOf as is and has no body of its own; a
+	// quote chirp comments on QuoteOf. Responses embed the referenced
+	// chirp, unless it has been deleted.
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	QuoteOf int `json:"quote_of,omitempty"`
+	RechirpedChirp *Chirp `json:"rechirped_chirp,omitempty"`
+	QuotedChirp *Chirp `json:"quoted_chirp,omitempty"`
+	RechirpCount int `json:"rechirp_count"`
+	QuoteCount int `json:"quote_count"`
+	LikeCount int `json:"like_count"`
+	// LikedByMe is only set in responses to authenticated requests.
+	LikedByMe *bool `json:"liked_by_me,omitempty"`
+}
+
+const (
+	chirpSortID		= "id"
+	chirpSortCreatedAt	= "created_at"
+	chirpSortUpdatedAt	= "updated_at"
+)
+
+// ChirpQuery selects and orders the chirps GetChirps returns. Zero values
+// mean no filter; Since is inclusive and Until exclusive, both on CreatedAt.
+type ChirpQuery struct {
+	AuthorID	int
+	// ViewerID is the user asking, who still sees their own chirps if
+	// they are shadowbanned.
+	ViewerID	int
+	Since		*time.Time
+	Until		*time.Time
+	SortBy		string
+	Descending	bool
+	// Filters are further conditions, from the query language.
+	Filters		[]func(Chirp) bool
+}
+
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	if q.AuthorID != 0 && chirp.AuthorID != q.AuthorID {
+		return false
+	}
+	if q.Since != nil && chirp.CreatedAt.Before(*q.Since) {
+		return false
+	}
+	if q.Until != nil && !chirp.CreatedAt.Before(*q.Until) {
+		return false
+	}
+	for _, filter := range q.Filters {
+		if !filter(chirp) {
+			return false
+		}
+	}
+	return true
 }
 
+// less orders chirps by the sort key, breaking ties by ID so the order is
+// total and cursors are unambiguous.
+func (q ChirpQuery) less() func(a, b Chirp) bool {
+	key := func(c Chirp) time.Time { return time.Time{} }
+	switch q.SortBy {
+	case chirpSortCreatedAt:
+		key = func(c Chirp) time.Time { return c.CreatedAt }
+	case chirpSortUpdatedAt:
+		key = func(c Chirp) time.Time { return c.UpdatedAt }
+	}
+	return func(a, b Chirp) bool {
+		ka, kb := key(a), key(b)
+		if !ka.Equal(kb) {
+			return ka.Before(kb) != q.Descending
+		}
+		return (a.ID < b.ID) != q.Descending
+	}
+}
+
+func validChirpSort(sortBy string) bool {
+	return sortBy == chirpSortID || sortBy == chirpSortCreatedAt || sortBy == chirpSortUpdatedAt
+}
+
+var errInvalidTime = errors.New("times must be RFC 3339 timestamps or YYYY-MM-DD dates")
+
+// parseTimeParam accepts an RFC 3339 timestamp or a date, taken as midnight
+// UTC.
+func parseTimeParam(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errInvalidTime
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errChirpTooLong		= errors.New("Chirp is too long")
+	errEditWindowClosed	= errors.New("the edit window for this chirp has closed")
+	errNotChirpAuthor	= errors.New("only the author can edit a chirp")
+	errRechirpNotEditable	= errors.New("rechirps can't be edited")
+)
+
+// ChirpRevision is one version of a chirp's body, current from PostedAt
+// until it was edited at ReplacedAt.
+type ChirpRevision struct {
+	Body		string		`json:"body"`
+	Entities	ChirpEntities	`json:"entities"`
+	PostedAt	time.Time	`json:"posted_at"`
+	ReplacedAt	*time.Time	`json:"replaced_at,omitempty"`
+}
+
+// prepareChirpBody applies the rules every posted or edited chirp body
+// must pass and returns it with bad words filtered out.
+func prepareChirpBody(body string) (string, error) {
+	if len(body) > 140 {
+		return "", errChirpTooLong
+	}
+	return cleanChirp(body), nil
+}
+
+// chirpEditWindow is how long after posting a chirp its author may edit it,
+// from CHIRP_EDIT_WINDOW or, for Chirpy Red users,
+// CHIRP_EDIT_WINDOW_CHIRPY_RED.
+func chirpEditWindow(user User) time.Duration {
+	if user.IsChirpyRed {
+		return envDuration("CHIRP_EDIT_WINDOW_CHIRPY_RED", time.Hour)
+	}
+	return envDuration("CHIRP_EDIT_WINDOW", 15*time.Minute)
+}
+
+// EditChirp replaces the body of userID's chirp, keeping the old version
+// in its history. Edits that leave the body as it was change nothing.
+func (db *DB) EditChirp(chirpID int, userID int, body string) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbs *DBStructure) error {
+		var ok bool
+		chirp, ok = dbs.Chirps[chirpID]
+		if !ok {
+			return errChirpNotFound
+		}
+		if chirp.AuthorID != userID {
+			return errNotChirpAuthor
+		}
+		if chirp.RechirpOf != 0 {
+			return errRechirpNotEditable
+		}
+		now := time.Now().UTC()
+		if now.Sub(chirp.CreatedAt) > chirpEditWindow(dbs.Users[userID].User) {
+			return errEditWindowClosed
+		}
+		if body == chirp.Body {
+			chirp = dbs.viewChirp(chirp, userID)
+			return nil
+		}
+
+		dbs.ChirpRevisions[chirpID] = append(dbs.ChirpRevisions[chirpID], ChirpRevision{
+			Body: chirp.Body,
+			Entities: chirp.Entities,
+			PostedAt: chirp.UpdatedAt,
+			ReplacedAt: &now,
+		})
+		chirp.Body = body
+		chirp.Entities = dbs.chirpEntities(body)
+		chirp.UpdatedAt = now
+		dbs.Chirps[chirpID] = chirp
+		chirp = dbs.viewChirp(chirp, userID)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// GetChirpHistory returns every version of a chirp, oldest first and ending
+// with the current one, if viewerID may see it.
+func (db *DB) GetChirpHistory(chirpID int, viewerID int) ([]ChirpRevision, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirp, ok := dbs.Chirps[chirpID]
+	if !ok || !dbs.visibleTo(chirp, viewerID) {
+		return nil, errChirpNotFound
+	}
+
+	revisions := append([]ChirpRevision{}, dbs.ChirpRevisions[chirpID]...)
+	return append(revisions, ChirpRevision{
+		Body: chirp.Body,
+		Entities: chirp.Entities,
+		PostedAt: chirp.UpdatedAt,
+	}), nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	exportDir		= "./exports"
+	exportRetention		= 7 * 24 * time.Hour
+	exportLinkLifetime	= 15 * time.Minute
+)
+
+const (
+	exportPending	= "pending"
+	exportComplete	= "complete"
+	exportFailed	= "failed"
+	exportExpired	= "expired"
+)
+
+// DataExport tracks a user's request for a copy of their data. The archive
+// is built in the background and kept until ExpiresAt.
+type DataExport struct {
+	ID		string		`json:"id"`
+	UserID		int		`json:"user_id"`
+	Status		string		`json:"status"`
+	CreatedAt	time.Time	`json:"created_at"`
+	CompletedAt	*time.Time	`json:"completed_at,omitempty"`
+	ExpiresAt	*time.Time	`json:"expires_at,omitempty"`
+	Error		string		`json:"error,omitempty"`
+}
+
+func (db *DB) CreateDataExport(userID int) (DataExport, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return DataExport{}, err
+	}
+	export := DataExport{
+		ID: id,
+		UserID: userID,
+		Status: exportPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = db.update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[userID]; !ok {
+			return errors.New("user not found")
+		}
+		dbs.DataExports[export.ID] = export
+		return nil
+	})
+	if err != nil {
+		return DataExport{}, err
+	}
+	return export, nil
+}
+
+func (db *DB) GetDataExport(id string) (DataExport, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return DataExport{}, err
+	}
+	export, ok := dbs.DataExports[id]
+	if !ok {
+		return DataExport{}, errors.New("export not found")
+	}
+	if export.ExpiresAt != nil && time.Now().UTC().After(*export.ExpiresAt) {
+		export.Status = exportExpired
+	}
+	return export, nil
+}
+
+func (db *DB) finishDataExport(id string, exportErr error) error {
+	return db.update(func(dbs *DBStructure) error {
+		export, ok := dbs.DataExports[id]
+		if !ok {
+			return errors.New("export not found")
+		}
+		now := time.Now().UTC()
+		export.CompletedAt = &now
+		if exportErr != nil {
+			export.Status = exportFailed
+			export.Error = exportErr.Error()
+		} else {
+			expiresAt := now.Add(exportRetention)
+			export.Status = exportComplete
+			export.ExpiresAt = &expiresAt
+		}
+		dbs.DataExports[id] = export
+		return nil
+	})
+}
+
+// PruneDataExports forgets expired exports and removes their archives.
+// Archives are only removed once the records are gone for good.
+func (db *DB) PruneDataExports() error {
+	expired := []string{}
+	err := db.update(func(dbs *DBStructure) error {
+		now := time.Now().UTC()
+		for id, export := range dbs.DataExports {
+			if export.ExpiresAt == nil || now.Before(*export.ExpiresAt) {
+				continue
+			}
+			expired = append(expired, id)
+			delete(dbs.DataExports, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		err := os.Remove(exportPath(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing export %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// runDataExport builds the archive for an export and records the outcome.
+func (db *DB) runDataExport(export DataExport) {
+	err := db.writeDataExport(export)
+	if err != nil {
+		log.Printf("error building export %s: %v", export.ID, err)
+		os.Remove(exportPath(export.ID))
+	}
+	err = db.finishDataExport(export.ID, err)
+	if err != nil {
+		// Most likely the account was deleted while the export ran; an
+		// archive nothing points to must not be left behind.
+		log.Printf("error finishing export %s: %v", export.ID, err)
+		os.Remove(exportPath(export.ID))
+	}
+}
+
+func (db *DB) writeDataExport(export DataExport) error {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, ok := dbs.Users[export.UserID]
+	if !ok {
+		return errors.New("user not found")
+	}
+
+	chirps := []Chirp{}
+	for _, chirp := range dbs.Chirps {
+		if chirp.AuthorID == user.ID {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].ID < chirps[j].ID
+	})
+
+	// Token values are credentials, so sessions are exported without them.
+	type session struct {
+		Type		string		`json:"type"`
+		Name		string		`json:"name,omitempty"`
+		Scopes		[]string	`json:"scopes,omitempty"`
+		ExpiresAt	*time.Time	`json:"expires_at,omitempty"`
+		LastUsedAt	*time.Time	`json:"last_used_at,omitempty"`
+	}
+	sessions := []session{}
+	for _, token := range dbs.RefreshTokens {
+		if token.UserID == user.ID {
+			expiresAt := token.ExpirationTime
+			sessions = append(sessions, session{Type: "refresh_token", ExpiresAt: &expiresAt})
+		}
+	}
+	for _, token := range dbs.AccessTokens {
+		if token.UserID == user.ID {
+			sessions = append(sessions, session{
+				Type: "personal_access_token",
+				Name: token.Name,
+				Scopes: token.Scopes,
+				ExpiresAt: token.ExpiresAt,
+				LastUsedAt: token.LastUsedAt,
+			})
+		}
+	}
+	for _, grant := range dbs.OAuthGrants {
+		if grant.UserID == user.ID {
+			expiresAt := grant.ExpiresAt
+			sessions = append(sessions, session{
+				Type: "oauth_grant",
+				Name: dbs.OAuthClients[grant.ClientID].Name,
+				Scopes: grant.Scopes,
+				ExpiresAt: &expiresAt,
+			})
+		}
+	}
+
+	subscriptions := []AuditEvent{}
+	target := "user:" + strconv.Itoa(user.ID)
+	for _, event := range dbs.AuditLog {
+		if event.Action == "user.upgrade" && event.Target == target {
+			subscriptions = append(subscriptions, event)
+		}
+	}
+
+	files := []struct {
+		name	string
+		data	interface{}
+	}{
+		{"profile.json", user.User},
+		{"chirps.json", chirps},
+		{"sessions.json", sessions},
+		{"subscription_history.json", subscriptions},
+	}
+
+	err = os.MkdirAll(exportDir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(exportPath(export.ID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func exportPath(id string) string {
+	return filepath.Join(exportDir, id+".zip")
+}
+
+// signExportLink returns the signature for a download link to an export
+// that is valid until expires (a Unix timestamp).
+func signExportLink(id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	fmt.Fprintf(mac, "export:%s:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyExportLink(id string, expires int64, signature string) bool {
+	if time.Now().UTC().Unix() > expires {
+		return false
+	}
+	expected := signExportLink(id, expires)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
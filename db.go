@@ -7,6 +7,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"time"
 )
 
 
@@ -20,6 +21,23 @@ type DBStructure struct {
 	Chirps		map[int]Chirp		`json:"chirps"`
 	Users		map[int]UserCredential	`json:"users"`
 	RefreshTokens	map[string]RefreshToken	`json:"refresh_tokens"`
+	AccessTokens	map[string]AccessTokenCredential	`json:"access_tokens"`
+	OAuthClients	map[string]OAuthClientCredential	`json:"oauth_clients"`
+	OAuthCodes	map[string]AuthorizationCode	`json:"oauth_codes"`
+	OAuthGrants	map[string]OAuthGrant	`json:"oauth_grants"`
+	DataExports	map[string]DataExport	`json:"data_exports"`
+	Invites		map[string]Invite	`json:"invites"`
+	ChirpTombstones	map[int]ChirpTombstone	`json:"chirp_tombstones"`
+	// Likes maps chirp IDs to the users who liked them and when.
+	Likes		map[int]map[int]time.Time	`json:"likes"`
+	// ChirpRevisions holds the earlier versions of edited chirps, oldest
+	// first.
+	ChirpRevisions	map[int][]ChirpRevision	`json:"chirp_revisions"`
+	AuditLog	[]AuditEvent		`json:"audit_log"`
+	LastUserID	int			`json:"last_user_id"`
+	LastChirpID	int			`json:"last_chirp_id"`
+	// SchemaVersion is the number of migrations applied.
+	SchemaVersion	int			`json:"schema_version"`
 }
 
 func NewDB(path string) (*DB, error) {
@@ -28,12 +46,43 @@ func NewDB(path string) (*DB, error) {
 		mux: &sync.RWMutex{},
 	}
 	err := db.ensureDB()
+	if err != nil {
+		return db, err
+	}
+	err = db.migrate()
 	return db, err
 }
 
 func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	return db.readDB()
+}
+
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.persistDB(dbStructure)
+}
+
+// update runs fn against the current database and writes the result back
+// while holding the lock, so concurrent read-modify-write cycles can't
+// overwrite each other. Nothing is written if fn returns an error.
+func (db *DB) update(fn func(dbs *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	dbs, err := db.readDB()
+	if err != nil {
+		return err
+	}
+	err = fn(&dbs)
+	if err != nil {
+		return err
+	}
+	return db.persistDB(dbs)
+}
+
+func (db *DB) readDB() (DBStructure, error) {
 	var chirps DBStructure = DBStructure{Chirps: map[int]Chirp{}}
 	data, err := os.ReadFile(db.path)
 	if err != nil {
@@ -46,12 +95,11 @@ func (db *DB) loadDB() (DBStructure, error) {
 		log.Printf("error unmarshling json: %v", err)
 		return chirps, err
 	}
+	chirps.initMaps()
 	return chirps, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+func (db *DB) persistDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		log.Printf("error unmarshling json in writeDB: %v", err)
@@ -68,26 +116,118 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 
 }
 
+// initMaps makes sure every collection exists, so databases written before
+// a collection was added can still be modified.
+func (dbs *DBStructure) initMaps() {
+	if dbs.Chirps == nil {
+		dbs.Chirps = map[int]Chirp{}
+	}
+	if dbs.Users == nil {
+		dbs.Users = map[int]UserCredential{}
+	}
+	if dbs.RefreshTokens == nil {
+		dbs.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbs.AccessTokens == nil {
+		dbs.AccessTokens = map[string]AccessTokenCredential{}
+	}
+	if dbs.OAuthClients == nil {
+		dbs.OAuthClients = map[string]OAuthClientCredential{}
+	}
+	if dbs.OAuthCodes == nil {
+		dbs.OAuthCodes = map[string]AuthorizationCode{}
+	}
+	if dbs.OAuthGrants == nil {
+		dbs.OAuthGrants = map[string]OAuthGrant{}
+	}
+	if dbs.DataExports == nil {
+		dbs.DataExports = map[string]DataExport{}
+	}
+	if dbs.Invites == nil {
+		dbs.Invites = map[string]Invite{}
+	}
+	if dbs.ChirpTombstones == nil {
+		dbs.ChirpTombstones = map[int]ChirpTombstone{}
+	}
+	if dbs.Likes == nil {
+		dbs.Likes = map[int]map[int]time.Time{}
+	}
+	if dbs.ChirpRevisions == nil {
+		dbs.ChirpRevisions = map[int][]ChirpRevision{}
+	}
+}
+
 
 
 
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
+// CreateChirp posts a chirp, as a reply to the chirp inReplyTo and quoting
+// the chirp quoteOf unless those are 0.
+func (db *DB) CreateChirp(body string, userID int, inReplyTo int, quoteOf int) (Chirp, error) {
 	log.Printf("creating new chirp: %v", body)
-	dbStructure, _ := db.loadDB()
-	chirp := Chirp{
-		ID: len(dbStructure.Chirps) + 1,
-		Body: body,
-		AuthorID: userID,
-	}
-	dbStructure.Chirps[chirp.ID] = chirp
-	err := db.writeDB(dbStructure)
+	var chirp Chirp
+	err := db.update(func(dbs *DBStructure) error {
+		now := time.Now().UTC()
+		chirp = Chirp{
+			ID: dbs.nextChirpID(),
+			Body: body,
+			AuthorID: userID,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Entities: dbs.chirpEntities(body),
+		}
+		chirp.ConversationID = chirp.ID
+		if inReplyTo != 0 {
+			target, ok := dbs.Chirps[inReplyTo]
+			if !ok || !dbs.visibleTo(target, userID) {
+				return errReplyParentNotFound
+			}
+			parent, ok := dbs.Chirps[dbs.originalChirpID(inReplyTo)]
+			if !ok || !dbs.visibleTo(parent, userID) {
+				return errReplyParentNotFound
+			}
+			chirp.InReplyTo = parent.ID
+			chirp.ConversationID = parent.ConversationID
+			parent.ReplyCount++
+			dbs.Chirps[parent.ID] = parent
+		}
+		if quoteOf != 0 {
+			target, ok := dbs.Chirps[quoteOf]
+			if !ok || !dbs.visibleTo(target, userID) {
+				return errQuotedChirpNotFound
+			}
+			quoted, ok := dbs.Chirps[dbs.originalChirpID(quoteOf)]
+			if !ok || !dbs.visibleTo(quoted, userID) {
+				return errQuotedChirpNotFound
+			}
+			chirp.QuoteOf = quoted.ID
+			quoted.QuoteCount++
+			dbs.Chirps[quoted.ID] = quoted
+		}
+		dbs.Chirps[chirp.ID] = chirp
+		chirp = dbs.viewChirp(chirp, userID)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 	return chirp, nil
 }
 
-func (db *DB) GetChirps(userID int, sortDirection string) ([]Chirp, error) {
+// nextChirpID hands out IDs that only ever increase, so a deleted chirp's ID
+// is never reused and cursors keyed on IDs stay valid.
+func (dbs *DBStructure) nextChirpID() int {
+	for id := range dbs.Chirps {
+		if id > dbs.LastChirpID {
+			dbs.LastChirpID = id
+		}
+	}
+	dbs.LastChirpID++
+	return dbs.LastChirpID
+}
+
+// GetChirps lists the chirps selected by query, in its order. Chirps by
+// shadowbanned authors are only included when the viewer is their author.
+func (db *DB) GetChirps(query ChirpQuery) ([]Chirp, error) {
 	log.Println("getting chirps")
 	dbStructure, err := db.loadDB()
 	if err != nil {
@@ -95,26 +235,44 @@ func (db *DB) GetChirps(userID int, sortDirection string) ([]Chirp, error) {
 		return []Chirp{}, err
 	}
 	chirps := []Chirp{}
+	shadowbanned := dbStructure.shadowbannedUsers()
 
 	for _, chirp := range dbStructure.Chirps {
-		if userID == 0 || userID == chirp.AuthorID {
-			chirps = append(chirps, chirp)
+		if shadowbanned[chirp.AuthorID] && chirp.AuthorID != query.ViewerID {
+			continue
+		}
+		if query.matches(chirp) {
+			chirps = append(chirps, dbStructure.viewChirp(chirp, query.ViewerID))
 		}
 	}
 
-	if sortDirection == "asc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID < chirps[j].ID
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID > chirps[j].ID
-		})
-	}
+	less := query.less()
+	sort.Slice(chirps, func(i, j int) bool {
+		return less(chirps[i], chirps[j])
+	})
 	return chirps, nil
 
 }
 
+// GetChirpsByID looks up chirps in the order of ids, skipping ones that no
+// longer exist or that the viewer may not see, like GetChirps.
+func (db *DB) GetChirpsByID(ids []int, viewerID int) ([]Chirp, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return []Chirp{}, err
+	}
+	shadowbanned := dbs.shadowbannedUsers()
+	chirps := []Chirp{}
+	for _, id := range ids {
+		chirp, ok := dbs.Chirps[id]
+		if !ok || (shadowbanned[chirp.AuthorID] && chirp.AuthorID != viewerID) {
+			continue
+		}
+		chirps = append(chirps, dbs.viewChirp(chirp, viewerID))
+	}
+	return chirps, nil
+}
+
 func (db *DB) GetChirp(id int) (Chirp, bool) {
 	dbs, _ := db.loadDB()
 	chirp, ok := dbs.Chirps[id]
@@ -125,16 +283,48 @@ func (db *DB) GetChirp(id int) (Chirp, bool) {
 }
 
 func (db *DB) DeleteChirp(chirpID int) error {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return err
+	return db.update(func(dbs *DBStructure) error {
+		dbs.deleteChirp(chirpID)
+		return nil
+	})
+}
+
+// deleteChirp removes a chirp as part of the caller's update, along with
+// its rechirps. A chirp that is part of a thread leaves a tombstone so the
+// rest of the thread stays connected.
+func (dbs *DBStructure) deleteChirp(chirpID int) {
+	chirp, ok := dbs.Chirps[chirpID]
+	if !ok {
+		return
 	}
-	_, ok := dbs.Chirps[chirpID]
-	if ok {
-		delete(dbs.Chirps, chirpID)
+	delete(dbs.Chirps, chirpID)
+	delete(dbs.Likes, chirpID)
+	delete(dbs.ChirpRevisions, chirpID)
+	if parent, ok := dbs.Chirps[chirp.InReplyTo]; ok {
+		parent.ReplyCount--
+		dbs.Chirps[parent.ID] = parent
+	}
+	if original, ok := dbs.Chirps[chirp.RechirpOf]; ok {
+		original.RechirpCount--
+		dbs.Chirps[original.ID] = original
+	}
+	if quoted, ok := dbs.Chirps[chirp.QuoteOf]; ok {
+		quoted.QuoteCount--
+		dbs.Chirps[quoted.ID] = quoted
+	}
+	if chirp.RechirpCount > 0 {
+		for id, other := range dbs.Chirps {
+			if other.RechirpOf == chirpID {
+				delete(dbs.Chirps, id)
+			}
+		}
+	}
+	if chirp.InReplyTo != 0 || chirp.ReplyCount > 0 {
+		dbs.ChirpTombstones[chirpID] = ChirpTombstone{
+			InReplyTo: chirp.InReplyTo,
+			ConversationID: chirp.ConversationID,
+		}
 	}
-	db.writeDB(dbs)
-	return nil
 }
 
 func (db *DB) CreateDB() (error) {
@@ -142,6 +332,16 @@ func (db *DB) CreateDB() (error) {
 		Chirps: map[int]Chirp{},
 		Users: map[int]UserCredential{},
 		RefreshTokens: map[string]RefreshToken{},
+		AccessTokens: map[string]AccessTokenCredential{},
+		OAuthClients: map[string]OAuthClientCredential{},
+		OAuthCodes: map[string]AuthorizationCode{},
+		OAuthGrants: map[string]OAuthGrant{},
+		DataExports: map[string]DataExport{},
+		Invites: map[string]Invite{},
+		ChirpTombstones: map[int]ChirpTombstone{},
+		Likes: map[int]map[int]time.Time{},
+		ChirpRevisions: map[int][]ChirpRevision{},
+		SchemaVersion: len(migrations),
 	}
 	return db.writeDB(dbs)
 }
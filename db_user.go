@@ -1,90 +1,284 @@
 package main
 
 import (
+	"bytes"
 	"errors"
-
-	"golang.org/x/crypto/bcrypt"
+	"os"
+	"sort"
+	"strconv"
 )
 
-func (db *DB) UpgradeUser(userID int) error {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+func (db *DB) UpgradeUser(userID int, audit AuditEvent) error {
+	return db.update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("user not found")
+		}
 
-	user, ok := dbs.Users[userID]
-	if !ok {
-		return errors.New("user not found")
-	}
+		user.IsChirpyRed = true
+		dbs.Users[userID] = user
+		audit.Details = map[string]string{
+			"plan": "chirpy_red",
+		}
+		dbs.appendAudit(audit)
+		return nil
+	})
+}
 
-	user.IsChirpyRed = true
-	dbs.Users[userID] = user
-	err = db.writeDB(dbs)
 
+// UpdateUser replaces a user's email and password. Like any password change
+// it logs the user out everywhere.
+func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
+	hashed, err := hashPassword(password)
 	if err != nil {
-		return err
+		return User{}, err
 	}
-	return nil
-}
-
 
+	var user UserCredential
+	err = db.update(func(dbs *DBStructure) error {
+		oldUser, found := dbs.Users[id]
+		if !found {
+			return errors.New("user not found")
+		}
+		if dbs.emailTaken(email, id) {
+			return errEmailTaken
+		}
 
-func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	dbs, err := db.loadDB()
+		user = oldUser
+		user.Email = email
+		user.Password = hashed
+		dbs.Users[id] = user
+		dbs.revokeSessions(id)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
+	return user.User, nil
+}
 
-	oldUser, found := dbs.Users[id]
-	if !found {
-		return User{}, errors.New("user not found")
-	}
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+// PatchUser changes only the supplied fields of a user; a nil email, handle
+// or password hash leaves that field as it is. Changing the password logs
+// the user out everywhere, as UpdateUser does.
+func (db *DB) PatchUser(id int, email *string, handle *string, hashed []byte) (User, error) {
+	var user UserCredential
+	err := db.update(func(dbs *DBStructure) error {
+		var found bool
+		user, found = dbs.Users[id]
+		if !found {
+			return errors.New("user not found")
+		}
+		if email != nil {
+			if dbs.emailTaken(*email, id) {
+				return errEmailTaken
+			}
+			user.Email = *email
+		}
+		if handle != nil {
+			if dbs.handleTaken(*handle, id) {
+				return errHandleTaken
+			}
+			user.Handle = *handle
+		}
+		if hashed != nil {
+			user.Password = hashed
+		}
+		dbs.Users[id] = user
+		if hashed != nil {
+			dbs.revokeSessions(id)
+		}
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
+	return user.User, nil
+}
 
-	user := UserCredential {
-		User: User {
-			ID: oldUser.ID,
-			Email: email, 
-		},
-		Password: hashed,
-	}
-	dbs.Users[id] = user
+func (db *DB) SetAdmin(id int, isAdmin bool) error {
+	return db.update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[id]
+		if !ok {
+			return errors.New("user not found")
+		}
+		user.IsAdmin = isAdmin
+		dbs.Users[id] = user
+		return nil
+	})
+}
 
-	
+// errPasswordChanged means the hash to be replaced is no longer the stored
+// one.
+var errPasswordChanged = errors.New("password has changed")
 
-	db.writeDB(dbs)
-	return user.User, nil
+// SetPasswordHash replaces a user's stored hash without touching anything
+// else, e.g. to upgrade it to the current hashing policy. It only does so
+// while the stored hash is still current, so a password changed in the
+// meantime is never overwritten.
+func (db *DB) SetPasswordHash(id int, current []byte, hashed []byte) error {
+	return db.update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[id]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if !bytes.Equal(user.Password, current) {
+			return errPasswordChanged
+		}
+		user.Password = hashed
+		dbs.Users[id] = user
+		return nil
+	})
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbs, err := db.loadDB()
+// CreateUser registers a new user. A non-empty inviteCode is redeemed in
+// the same update, so the invite is only used up if the user is created.
+func (db *DB) CreateUser(email string, password string, handle string, inviteCode string) (User, error) {
+	hashed, err := hashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 0)
-	if err != nil {
-		return User{}, nil
-	}
-	user := UserCredential{
-		User: User{
-			ID: len(dbs.Users) + 1,
-			Email: email,
-			IsChirpyRed: false,
-		},
-		Password: hashed,
-	}
-	dbs.Users[user.ID] = user
-	err = db.writeDB(dbs)
+	var user UserCredential
+	err = db.update(func(dbs *DBStructure) error {
+		if dbs.emailTaken(email, 0) {
+			return errEmailTaken
+		}
+		if handle != "" && dbs.handleTaken(handle, 0) {
+			return errHandleTaken
+		}
+		user = UserCredential{
+			User: User{
+				ID: dbs.nextUserID(),
+				Email: email,
+				IsChirpyRed: false,
+				Handle: handle,
+			},
+			Password: hashed,
+		}
+		if inviteCode != "" {
+			inviterID, err := dbs.redeemInvite(inviteCode, user.ID)
+			if err != nil {
+				return err
+			}
+			user.InvitedBy = inviterID
+		}
+		dbs.Users[user.ID] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 	return user.User, nil
 }
 
+// DeleteUser removes a user together with everything that lets them act on
+// the service: refresh tokens, access tokens, OAuth clients and grants,
+// invites and any data exports. Their chirps are deleted or, with anonymize
+// set, kept without an author.
+func (db *DB) DeleteUser(id int, anonymize bool, audit AuditEvent) error {
+	// Export files are only removed once the deletion is saved.
+	exportFiles := []string{}
+	err := db.update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[id]; !ok {
+			return errors.New("user not found")
+		}
+		delete(dbs.Users, id)
+
+		for key, token := range dbs.RefreshTokens {
+			if token.UserID == id {
+				delete(dbs.RefreshTokens, key)
+			}
+		}
+		for key, token := range dbs.AccessTokens {
+			if token.UserID == id {
+				delete(dbs.AccessTokens, key)
+			}
+		}
+		for key, grant := range dbs.OAuthGrants {
+			if grant.UserID == id {
+				delete(dbs.OAuthGrants, key)
+			}
+		}
+		for key, code := range dbs.OAuthCodes {
+			if code.UserID == id {
+				delete(dbs.OAuthCodes, key)
+			}
+		}
+		for key, client := range dbs.OAuthClients {
+			if client.OwnerID != id {
+				continue
+			}
+			delete(dbs.OAuthClients, key)
+			for grantKey, grant := range dbs.OAuthGrants {
+				if grant.ClientID == client.ID {
+					delete(dbs.OAuthGrants, grantKey)
+				}
+			}
+		}
+
+		for code, invite := range dbs.Invites {
+			if invite.CreatorID == id {
+				delete(dbs.Invites, code)
+			}
+		}
+		for key, export := range dbs.DataExports {
+			if export.UserID == id {
+				exportFiles = append(exportFiles, exportPath(key))
+				delete(dbs.DataExports, key)
+			}
+		}
+
+		for chirpID := range dbs.Likes {
+			dbs.unlike(chirpID, id)
+		}
+
+		chirpCount := 0
+		for chirpID, chirp := range dbs.Chirps {
+			if chirp.AuthorID != id {
+				continue
+			}
+			chirpCount++
+			// A rechirp has nothing of the user's to keep.
+			if anonymize && chirp.RechirpOf == 0 {
+				chirp.AuthorID = 0
+				dbs.Chirps[chirpID] = chirp
+			} else {
+				dbs.deleteChirp(chirpID)
+			}
+		}
+
+		policy := "delete"
+		if anonymize {
+			policy = "anonymize"
+		}
+		audit.Details = map[string]string{
+			"chirp_policy": policy,
+			"chirps": strconv.Itoa(chirpCount),
+		}
+		dbs.appendAudit(audit)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range exportFiles {
+		os.Remove(file)
+	}
+	return nil
+}
+
+// nextUserID hands out IDs that are never reused, even after the user with
+// the highest ID is deleted.
+func (dbs *DBStructure) nextUserID() int {
+	for id := range dbs.Users {
+		if id > dbs.LastUserID {
+			dbs.LastUserID = id
+		}
+	}
+	dbs.LastUserID++
+	return dbs.LastUserID
+}
+
 func (db *DB) GetUsers() ([]User, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
@@ -110,16 +304,69 @@ func (db *DB) GetUser(id int) (User, error) {
 	return user.User, nil
 }
 
+func (db *DB) GetUserCredential(id int) (UserCredential, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return UserCredential{}, err
+	}
+	user, ok := dbs.Users[id]
+	if !ok {
+		return UserCredential{}, errors.New("user not found")
+	}
+	return user, nil
+}
+
+// GetUserByEmail finds a user by normalized email. Should older data hold
+// duplicates, the account with the lowest ID wins so logins are
+// deterministic.
 func (db *DB) GetUserByEmail(email string) (UserCredential, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
 		return UserCredential{}, err
 	}
 
+	key := emailKey(email)
+	found := UserCredential{}
+	for _, user := range dbs.Users {
+		if emailKey(user.Email) == key && (found.ID == 0 || user.ID < found.ID) {
+			found = user
+		}
+	}
+	if found.ID == 0 {
+		return UserCredential{}, errors.New("user not found")
+	}
+	return found, nil
+}
+
+// FindDuplicateEmails groups the IDs of users whose emails are the same
+// once normalized, keyed by that normalized email.
+func (db *DB) FindDuplicateEmails() (map[string][]int, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	byEmail := map[string][]int{}
+	for _, user := range dbs.Users {
+		key := emailKey(user.Email)
+		byEmail[key] = append(byEmail[key], user.ID)
+	}
+	duplicates := map[string][]int{}
+	for email, ids := range byEmail {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			duplicates[email] = ids
+		}
+	}
+	return duplicates, nil
+}
+
+func (dbs *DBStructure) emailTaken(email string, exceptUserID int) bool {
+	key := emailKey(email)
 	for _, user := range dbs.Users {
-		if user.Email == email {
-			return user, nil
+		if user.ID != exceptUserID && emailKey(user.Email) == key {
+			return true
 		}
 	}
-	return UserCredential{}, errors.New("user not found")
+	return false
 }
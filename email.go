@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var errEmailTaken = errors.New("email already in use")
+
+// normalizeEmail validates an address and returns it in the form it is
+// stored in: trimmed and lower-cased, without a display name.
+func normalizeEmail(email string) (string, error) {
+	normalized := emailKey(email)
+	if normalized == "" {
+		return "", errors.New("email is required")
+	}
+	addr, err := mail.ParseAddress(normalized)
+	if err != nil || addr.Address != normalized {
+		return "", errors.New("invalid email address")
+	}
+	if !strings.Contains(normalized[strings.LastIndex(normalized, "@")+1:], ".") {
+		return "", errors.New("invalid email address")
+	}
+	return normalized, nil
+}
+
+// emailKey is the comparison key for emails, also used for addresses
+// stored before emails were normalized.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envBool reads a boolean setting, falling back when it is unset or not a
+// boolean.
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envDuration reads a duration setting such as "15m", falling back when it
+// is unset, invalid or not positive.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// runFsck reports problems in the database that the server can't fix on its
+// own and returns the process exit code: 0 if the database is clean, 1 if
+// problems were found and 2 if it couldn't be checked.
+func runFsck(db *DB) int {
+	duplicates, err := db.FindDuplicateEmails()
+	if err != nil {
+		fmt.Printf("error loading database: %v\n", err)
+		return 2
+	}
+
+	emails := []string{}
+	for email := range duplicates {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	for _, email := range emails {
+		fmt.Printf("duplicate email %s: users %v\n", email, duplicates[email])
+	}
+	if len(emails) > 0 {
+		fmt.Printf("%d duplicate emails found; logins use the lowest user ID\n", len(emails))
+		return 1
+	}
+	fmt.Println("no problems found")
+	return 0
+}
@@ -2,14 +2,14 @@ module github.com/bhashimoto/Chirpy-bootdev
 
 go 1.22.5
 
-replace (
-	internal/db v1.0.0 => ./internal/db/
-)
+replace internal/db v1.0.0 => ./internal/db/
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.25.0
+	golang.org/x/text v0.16.0
 	internal/db v1.0.0
 )
 
+require golang.org/x/sys v0.22.0 // indirect
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (cfg *apiConfig) HandleAccessTokenCreate(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeTokens)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	type parameters struct {
+		Name			string		`json:"name"`
+		Scopes			[]string	`json:"scopes"`
+		ExpiresInSeconds	int		`json:"expires_in_seconds,omitempty"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "name is required")
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, 400, "at least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !delegatedScopes[scope] {
+			respondWithError(w, 400, "invalid scope: "+scope)
+			return
+		}
+	}
+	if params.ExpiresInSeconds < 0 {
+		respondWithError(w, 400, "expires_in_seconds must be positive")
+		return
+	}
+
+	var expiresAt *time.Time
+	if params.ExpiresInSeconds > 0 {
+		t := time.Now().UTC().Add(time.Second * time.Duration(params.ExpiresInSeconds))
+		expiresAt = &t
+	}
+
+	token, tokenString, err := cfg.db.CreateAccessToken(userID, params.Name, params.Scopes, expiresAt)
+	if err != nil {
+		respondWithError(w, 500, "error creating token")
+		return
+	}
+
+	event := newAuditEvent(r, userID, "access_token.create", "access_token:"+token.ID)
+	event.Details = map[string]string{"scopes": strings.Join(token.Scopes, " ")}
+	cfg.audit(event)
+
+	ret := struct {
+		AccessToken
+		Token string `json:"token"`
+	}{
+		AccessToken: token,
+		Token: tokenString,
+	}
+	respondWithJSON(w, 201, ret)
+}
+
+func (cfg *apiConfig) HandleAccessTokenList(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeTokens)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	tokens, err := cfg.db.GetAccessTokens(userID)
+	if err != nil {
+		respondWithError(w, 500, "error loading tokens")
+		return
+	}
+	respondWithJSON(w, 200, tokens)
+}
+
+func (cfg *apiConfig) HandleAccessTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeTokens)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	tokenID := r.PathValue("tokenID")
+	err = cfg.db.RevokeAccessToken(userID, tokenID)
+	if err != nil {
+		respondWithError(w, 404, "token not found")
+		return
+	}
+	cfg.audit(newAuditEvent(r, userID, "access_token.revoke", "access_token:"+tokenID))
+	respondWithJSON(w, 204, "")
+}
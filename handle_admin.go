@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditDefaultPageSize	= 50
+	auditMaxPageSize	= 500
+)
+
+// HandleAuditLog lists audit events, newest first. Filters: actor_id,
+// action, target, outcome, and since/until as RFC 3339 times; pages with
+// limit and offset.
+func (cfg *apiConfig) HandleAuditLog(w http.ResponseWriter, r *http.Request) {
+	_, err := cfg.authenticateAdmin(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		Outcome: query.Get("outcome"),
+		Limit: auditDefaultPageSize,
+	}
+
+	intParams := []struct {
+		name	string
+		dest	*int
+	}{
+		{"actor_id", &filter.ActorID},
+		{"limit", &filter.Limit},
+		{"offset", &filter.Offset},
+	}
+	for _, param := range intParams {
+		if value := query.Get(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				respondWithError(w, 400, "invalid "+param.name)
+				return
+			}
+			*param.dest = n
+		}
+	}
+	if filter.Limit == 0 || filter.Limit > auditMaxPageSize {
+		filter.Limit = auditMaxPageSize
+	}
+
+	timeParams := []struct {
+		name	string
+		dest	*time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+	for _, param := range timeParams {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondWithError(w, 400, "invalid "+param.name+", expected an RFC 3339 time")
+				return
+			}
+			*param.dest = t
+		}
+	}
+
+	events, total, err := cfg.db.GetAuditEvents(filter)
+	if err != nil {
+		respondWithError(w, 500, "error loading audit log")
+		return
+	}
+
+	ret := struct {
+		Events		[]AuditEvent	`json:"events"`
+		Total		int		`json:"total"`
+		NextOffset	*int		`json:"next_offset"`
+	}{
+		Events: events,
+		Total: total,
+	}
+	if next := filter.Offset + len(events); next < total {
+		ret.NextOffset = &next
+	}
+	respondWithJSON(w, 200, ret)
+}
+
+// handleModerateUser returns the handler for one moderation action.
+// Suspensions need duration_seconds; every action needs a reason.
+func (cfg *apiConfig) handleModerateUser(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminID, err := cfg.authenticateAdmin(r)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		userID, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			respondWithError(w, 400, "invalid user id")
+			return
+		}
+		if userID == adminID {
+			respondWithError(w, 400, "admins can't moderate themselves")
+			return
+		}
+
+		type parameters struct {
+			Reason		string	`json:"reason"`
+			DurationSeconds	int	`json:"duration_seconds,omitempty"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		params := parameters{}
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "bad request")
+			return
+		}
+		if params.Reason == "" {
+			respondWithError(w, 400, "reason is required")
+			return
+		}
+		if action == moderationSuspend && params.DurationSeconds <= 0 {
+			respondWithError(w, 400, "duration_seconds must be positive")
+			return
+		}
+
+		moderation, err := cfg.db.ModerateUser(
+			userID,
+			action,
+			time.Second*time.Duration(params.DurationSeconds),
+			params.Reason,
+			newAuditEvent(r, adminID, "user."+action, userTarget(userID)),
+		)
+		if err != nil {
+			respondWithError(w, 404, "user not found")
+			return
+		}
+		respondWithJSON(w, 200, moderation)
+	}
+}
+
+func (cfg *apiConfig) HandleUserModeration(w http.ResponseWriter, r *http.Request) {
+	_, err := cfg.authenticateAdmin(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	user, err := cfg.db.GetUserCredential(userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	ret := struct {
+		User
+		Moderation Moderation `json:"moderation"`
+	}{
+		User: user.User,
+		Moderation: user.Moderation,
+	}
+	respondWithJSON(w, 200, ret)
+}
+
+const impersonationTokenSeconds = 15 * 60
+
+// HandleImpersonate mints a short-lived token that acts as the target user
+// for support staff. See checkImpersonation for how it is restricted.
+func (cfg *apiConfig) HandleImpersonate(w http.ResponseWriter, r *http.Request) {
+	adminID, err := cfg.authenticateAdmin(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil || params.Reason == "" {
+		respondWithError(w, 400, "reason is required")
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	if user.IsAdmin {
+		respondWithError(w, 403, "admins can't be impersonated")
+		return
+	}
+
+	claims, err := cfg.newClaims(user.ID, impersonationTokenSeconds)
+	if err != nil {
+		respondWithError(w, 500, "error creating token")
+		return
+	}
+	claims.ImpersonatorID = adminID
+	token, err := cfg.signJWT(claims)
+	if err != nil {
+		respondWithError(w, 500, "error creating token")
+		return
+	}
+
+	event := newAuditEvent(r, adminID, "user.impersonate", userTarget(user.ID))
+	event.Details = map[string]string{"reason": params.Reason}
+	cfg.audit(event)
+
+	ret := struct {
+		Token		string		`json:"token"`
+		ExpiresAt	time.Time	`json:"expires_at"`
+		UserID		int		`json:"user_id"`
+		ImpersonatorID	int		`json:"impersonator_id"`
+	}{
+		Token: token,
+		ExpiresAt: claims.ExpiresAt.Time,
+		UserID: user.ID,
+		ImpersonatorID: adminID,
+	}
+	respondWithJSON(w, 200, ret)
+}
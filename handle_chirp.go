@@ -2,22 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (cfg *apiConfig) HandleChirpDelete(w http.ResponseWriter, r *http.Request) {
-	userIDString, err := ValidateJWT(r)
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
 	if err != nil {
-		respondWithError(w, 403, "unauthorized")
+		respondWithAuthError(w, err)
 		return
 	}
-	userID, err := strconv.Atoi(userIDString)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "internal error")
-	}
 
 	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
@@ -31,6 +30,10 @@ func (cfg *apiConfig) HandleChirpDelete(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	if chirp.AuthorID != userID{
+		event := newAuditEvent(r, userID, "chirp.delete", "chirp:"+strconv.Itoa(chirp.ID))
+		event.Outcome = auditFailure
+		event.Details = map[string]string{"reason": "not the author"}
+		cfg.audit(event)
 		respondWithError(w, 403, "unauthorized")
 		return
 	}
@@ -39,6 +42,8 @@ func (cfg *apiConfig) HandleChirpDelete(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "error deleting chirp")
 		return
 	}
+	cfg.search.remove(chirp.ID)
+	cfg.audit(newAuditEvent(r, userID, "chirp.delete", "chirp:"+strconv.Itoa(chirp.ID)))
 	respondWithJSON(w, 204, "")
 
 }
@@ -48,45 +53,230 @@ func (cfg *apiConfig) HandleGetChirp(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("error getting id: %v", err)
 	}
-	db := createDB()
-	chirp, found := db.GetChirp(id)
-	if !found {
+	chirps, err := cfg.db.GetChirpsByID([]int{id}, cfg.viewerID(r))
+	if err != nil || len(chirps) == 0 {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	respondWithJSON(w, 200, chirps[0])
+}
+
+// HandleChirpEdit lets the author change a chirp's body within the edit
+// window. The body goes through the same checks and filtering as a new
+// chirp's.
+func (cfg *apiConfig) HandleChirpEdit(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	type parameters struct {
+		Chirp string `json:"body"`
+	}
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+	body, err := prepareChirpBody(params.Chirp)
+	if errors.Is(err, errChirpTooLong) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	target := "chirp:" + strconv.Itoa(chirpID)
+	chirp, err := cfg.db.EditChirp(chirpID, userID, body)
+	switch {
+	case errors.Is(err, errChirpNotFound):
 		respondWithError(w, 404, "Chirp not found")
+		return
+	case errors.Is(err, errNotChirpAuthor), errors.Is(err, errEditWindowClosed), errors.Is(err, errRechirpNotEditable):
+		event := newAuditEvent(r, userID, "chirp.edit", target)
+		event.Outcome = auditFailure
+		event.Details = map[string]string{"reason": err.Error()}
+		cfg.audit(event)
+		respondWithError(w, 403, err.Error())
+		return
+	case err != nil:
+		respondWithError(w, 500, "error editing chirp")
+		return
 	}
+	cfg.search.add(chirp)
+	cfg.audit(newAuditEvent(r, userID, "chirp.edit", target))
 	respondWithJSON(w, 200, chirp)
 }
 
+// HandleChirpHistory lists every version of a chirp, oldest first.
+func (cfg *apiConfig) HandleChirpHistory(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	revisions, err := cfg.db.GetChirpHistory(chirpID, cfg.viewerID(r))
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Printf("error loading history of chirp %d: %v", chirpID, err)
+		respondWithError(w, 500, "error loading history")
+		return
+	}
+	respondWithJSON(w, 200, revisions)
+}
+
+// HandleChirpThread returns the conversation around a chirp: the chirps it
+// replies to and, up to depth levels down, the replies to it.
+func (cfg *apiConfig) HandleChirpThread(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	depth := defaultThreadDepth
+	if s := r.URL.Query().Get("depth"); s != "" {
+		depth, err = strconv.Atoi(s)
+		if err != nil || depth < 1 {
+			respondWithError(w, 400, "depth must be a positive integer")
+			return
+		}
+		depth = min(depth, maxThreadDepth)
+	}
+
+	thread, err := cfg.db.GetThread(chirpID, depth, cfg.viewerID(r))
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if err != nil {
+		log.Printf("error loading thread of chirp %d: %v", chirpID, err)
+		respondWithError(w, 500, "error loading thread")
+		return
+	}
+	respondWithJSON(w, 200, thread)
+}
+
+// viewerID identifies the user making an optionally authenticated read
+// request, or returns 0 for anonymous requests and bad credentials.
+func (cfg *apiConfig) viewerID(r *http.Request) int {
+	if r.Header.Get("Authorization") == "" {
+		if _, err := r.Cookie(accessCookieName); err != nil {
+			return 0
+		}
+	}
+	userID, err := cfg.authenticate(r, scopeChirpsRead)
+	if err != nil {
+		return 0
+	}
+	return userID
+}
+
 func (cfg *apiConfig) HandleGetChirps(w http.ResponseWriter, r *http.Request) {
-	cfg.db.loadDB()
+	cfg.serveChirpList(w, r)
+}
 
-	userID := 0
-	userIDString := r.URL.Query().Get("author_id")
-	if userIDString != "" {
-		userID, _ = strconv.Atoi(userIDString)
+// serveChirpList responds with the page of chirps selected by the request's
+// query parameters and any further filters.
+func (cfg *apiConfig) serveChirpList(w http.ResponseWriter, r *http.Request, filters ...func(Chirp) bool) {
+	query, err := chirpQueryParams(r)
+	var syntaxErr *queryError
+	if errors.As(err, &syntaxErr) {
+		respondWithQueryError(w, r.URL.Query().Get("query"), syntaxErr)
+		return
 	}
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	query.ViewerID = cfg.viewerID(r)
+	query.Filters = append(query.Filters, filters...)
 
-	sortDirection := r.URL.Query().Get("sort")
-	if sortDirection != "desc" {
-		sortDirection = "asc"
+	limit, cursor, err := pageParams(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
 	}
 
-	chirps, err := cfg.db.GetChirps(userID, sortDirection)
+	chirps, err := cfg.db.GetChirps(query)
 	if err != nil {
 		log.Println("error loading chirps")
 		respondWithError(w, 500, "error loading chirps")
+		return
+	}
+	page := paginateChirps(chirps, query.less(), cursor, limit)
+	setPageLinks(w, r, page)
+	respondWithJSON(w, 200, page.Chirps)
+}
+
+// chirpQueryParams reads the author_id, since, until, query, sort and
+// sort_by query parameters.
+func chirpQueryParams(r *http.Request) (ChirpQuery, error) {
+	query := ChirpQuery{SortBy: chirpSortID}
+	values := r.URL.Query()
+
+	if s := values.Get("author_id"); s != "" {
+		query.AuthorID, _ = strconv.Atoi(s)
+	}
+	for _, param := range []struct {
+		name	string
+		dest	**time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	} {
+		s := values.Get(param.name)
+		if s == "" {
+			continue
+		}
+		t, err := parseTimeParam(s)
+		if err != nil {
+			return ChirpQuery{}, fmt.Errorf("%s: %w", param.name, err)
+		}
+		*param.dest = &t
+	}
+
+	if s := values.Get("query"); s != "" {
+		filters, err := parseChirpQuery(s)
+		if err != nil {
+			return ChirpQuery{}, err
+		}
+		query.Filters = filters
+	}
+
+	if s := values.Get("sort_by"); s != "" {
+		if !validChirpSort(s) {
+			return ChirpQuery{}, errors.New("sort_by must be id, created_at or updated_at")
+		}
+		query.SortBy = s
 	}
-	respondWithJSON(w, 200, chirps)
+	query.Descending = values.Get("sort") == "desc"
+	return query, nil
 }
 
 func (cfg *apiConfig) HandleCreateChirp(w http.ResponseWriter, r *http.Request) {
-	userIDString, err := ValidateJWT(r)
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
 	if err != nil {
-		respondWithError(w, 401, "user not authorized")
+		respondWithAuthError(w, err)
 		return
 	}
 
 	type parameters struct {
 		Chirp string `json:"body"`
+		InReplyTo int `json:"in_reply_to,omitempty"`
+		QuoteOf int `json:"quote_of,omitempty"`
 	}
 	decoder := json.NewDecoder(r.Body)
 
@@ -99,17 +289,26 @@ func (cfg *apiConfig) HandleCreateChirp(w http.ResponseWriter, r *http.Request)
 	}
 	
 
-	if len(params.Chirp) > 140 {
-		respondWithError(w, 500, "Chirp is too long")
+	body, err := prepareChirpBody(params.Chirp)
+	if errors.Is(err, errChirpTooLong) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, err.Error())
 		return
 	}
 
-	userID, _ := strconv.Atoi(userIDString)
-	chirp, err := cfg.db.CreateChirp(cleanChirp(params.Chirp), userID)
+	chirp, err := cfg.db.CreateChirp(body, userID, params.InReplyTo, params.QuoteOf)
+	if errors.Is(err, errReplyParentNotFound) || errors.Is(err, errQuotedChirpNotFound) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, 500, "error creating chirp")
 		return
 	}
+	cfg.search.add(chirp)
 
 	respondWithJSON(w, 201, chirp)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type dataExportResponse struct {
+	DataExport
+	DownloadURL		string		`json:"download_url,omitempty"`
+	DownloadURLExpiresAt	*time.Time	`json:"download_url_expires_at,omitempty"`
+}
+
+func newDataExportResponse(export DataExport) dataExportResponse {
+	ret := dataExportResponse{DataExport: export}
+	if export.Status != exportComplete {
+		return ret
+	}
+	expiresAt := time.Now().UTC().Add(exportLinkLifetime)
+	if expiresAt.After(*export.ExpiresAt) {
+		expiresAt = *export.ExpiresAt
+	}
+	expires := expiresAt.Unix()
+	ret.DownloadURL = fmt.Sprintf("/api/exports/%s/download?expires=%d&signature=%s", export.ID, expires, signExportLink(export.ID, expires))
+	ret.DownloadURLExpiresAt = &expiresAt
+	return ret
+}
+
+func (cfg *apiConfig) HandleDataExportCreate(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	err = cfg.db.PruneDataExports()
+	if err != nil {
+		log.Printf("error pruning exports: %v", err)
+	}
+
+	export, err := cfg.db.CreateDataExport(userID)
+	if err != nil {
+		respondWithError(w, 500, "error creating export")
+		return
+	}
+	go cfg.db.runDataExport(export)
+
+	respondWithJSON(w, 202, newDataExportResponse(export))
+}
+
+func (cfg *apiConfig) HandleDataExportStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	export, err := cfg.db.GetDataExport(r.PathValue("exportID"))
+	if err != nil || export.UserID != userID {
+		respondWithError(w, 404, "export not found")
+		return
+	}
+	respondWithJSON(w, 200, newDataExportResponse(export))
+}
+
+// HandleDataExportDownload serves an archive to anyone holding a valid
+// signed link, so it can be opened directly in a browser.
+func (cfg *apiConfig) HandleDataExportDownload(w http.ResponseWriter, r *http.Request) {
+	exportID := r.PathValue("exportID")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || !verifyExportLink(exportID, expires, r.URL.Query().Get("signature")) {
+		respondWithError(w, 403, "download link is invalid or has expired")
+		return
+	}
+
+	export, err := cfg.db.GetDataExport(exportID)
+	if err != nil || export.Status != exportComplete {
+		respondWithError(w, 404, "export not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%s.zip"`, export.ID))
+	http.ServeFile(w, r, exportPath(export.ID))
+}
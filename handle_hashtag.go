@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HandleHashtagChirps lists the chirps tagged with a hashtag. It takes the
+// same filtering, sorting and paging parameters as GET /api/chirps.
+func (cfg *apiConfig) HandleHashtagChirps(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	if !validHashtag(tag) {
+		respondWithError(w, 400, "invalid hashtag")
+		return
+	}
+
+	cfg.serveChirpList(w, r, hashtagFilter(tag))
+}
+
+func (cfg *apiConfig) HandleTrends(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			respondWithError(w, 400, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxTrends)
+	}
+
+	trends, computedAt := cfg.trends.get()
+	respondWithJSON(w, 200, struct {
+		Trends		[]Trend		`json:"trends"`
+		ComputedAt	time.Time	`json:"computed_at"`
+	}{
+		Trends: trends[:min(limit, len(trends))],
+		ComputedAt: computedAt,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) HandleInviteCreate(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	type parameters struct {
+		MaxUses			int `json:"max_uses,omitempty"`
+		ExpiresInSeconds	int `json:"expires_in_seconds,omitempty"`
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "bad request")
+			return
+		}
+	}
+
+	if params.MaxUses == 0 {
+		params.MaxUses = 1
+	}
+	if params.MaxUses < 0 || params.ExpiresInSeconds < 0 {
+		respondWithError(w, 400, "max_uses and expires_in_seconds must be positive")
+		return
+	}
+	var expiresAt *time.Time
+	if params.ExpiresInSeconds > 0 {
+		t := time.Now().UTC().Add(time.Second * time.Duration(params.ExpiresInSeconds))
+		expiresAt = &t
+	}
+
+	invite, err := cfg.db.CreateInvite(userID, params.MaxUses, expiresAt)
+	if errors.Is(err, errInviteQuota) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "error creating invite")
+		return
+	}
+	respondWithJSON(w, 201, invite)
+}
+
+func (cfg *apiConfig) HandleInviteList(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	invites, err := cfg.db.GetInvites(userID)
+	if err != nil {
+		respondWithError(w, 500, "error loading invites")
+		return
+	}
+	respondWithJSON(w, 200, invites)
+}
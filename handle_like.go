@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// HandleLike likes a chirp for the user and returns it with the new count.
+// Liking a chirp again is not an error.
+func (cfg *apiConfig) HandleLike(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	chirp, err := cfg.db.Like(chirpID, userID)
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "error liking chirp")
+		return
+	}
+	respondWithJSON(w, 200, chirp)
+}
+
+// HandleUnlike takes back the user's like, succeeding whether or not they
+// liked the chirp.
+func (cfg *apiConfig) HandleUnlike(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	err = cfg.db.Unlike(chirpID, userID)
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "error unliking chirp")
+		return
+	}
+	respondWithJSON(w, 204, "")
+}
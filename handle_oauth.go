@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var consentPage = template.Must(template.New("consent").Parse(`
+<html>
+	<body>
+		<h1>Authorize {{.ClientName}}</h1>
+		<p>{{.ClientName}} would like to:</p>
+		<ul>
+			{{range .Scopes}}<li>{{.}}</li>{{end}}
+		</ul>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<form method="POST" action="/api/oauth/authorize">
+			<input type="hidden" name="client_id" value="{{.ClientID}}">
+			<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+			<input type="hidden" name="scope" value="{{.Scope}}">
+			<input type="hidden" name="state" value="{{.State}}">
+			<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+			<input type="hidden" name="code_challenge_method" value="S256">
+			<input type="hidden" name="response_type" value="code">
+			<p><label>Email <input type="email" name="email"></label></p>
+			<p><label>Password <input type="password" name="password"></label></p>
+			<button type="submit" name="decision" value="approve">Allow</button>
+			<button type="submit" name="decision" value="deny">Deny</button>
+		</form>
+	</body>
+</html>
+`))
+
+type authorizeRequest struct {
+	ClientName	string
+	ClientID	string
+	RedirectURI	string
+	Scope		string
+	Scopes		[]string
+	State		string
+	CodeChallenge	string
+	Error		string
+}
+
+func respondWithOAuthError(w http.ResponseWriter, code int, oauthError string, description string) {
+	respondWithJSON(w, code, struct {
+		Error			string `json:"error"`
+		ErrorDescription	string `json:"error_description,omitempty"`
+	}{
+		Error: oauthError,
+		ErrorDescription: description,
+	})
+}
+
+func redirectWithOAuthError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, oauthError string) {
+	values := url.Values{}
+	values.Set("error", oauthError)
+	if state != "" {
+		values.Set("state", state)
+	}
+	http.Redirect(w, r, appendQuery(redirectURI, values), http.StatusFound)
+}
+
+func appendQuery(uri string, values url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + values.Encode()
+	}
+	return uri + "?" + values.Encode()
+}
+
+// parseAuthorizeRequest validates the parameters shared by the consent page
+// and its form submission. Errors that make the redirect URI untrustworthy
+// are reported to the user directly; all others go back to the client.
+func (cfg *apiConfig) parseAuthorizeRequest(w http.ResponseWriter, r *http.Request, values url.Values) (authorizeRequest, bool) {
+	client, err := cfg.db.GetOAuthClient(values.Get("client_id"))
+	if err != nil {
+		respondWithError(w, 400, "unknown client")
+		return authorizeRequest{}, false
+	}
+	redirectURI := values.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		respondWithError(w, 400, "redirect_uri is not registered for this client")
+		return authorizeRequest{}, false
+	}
+
+	state := values.Get("state")
+	if values.Get("response_type") != "code" {
+		redirectWithOAuthError(w, r, redirectURI, state, "unsupported_response_type")
+		return authorizeRequest{}, false
+	}
+	if values.Get("code_challenge") == "" || values.Get("code_challenge_method") != "S256" {
+		redirectWithOAuthError(w, r, redirectURI, state, "invalid_request")
+		return authorizeRequest{}, false
+	}
+
+	scopes := strings.Fields(values.Get("scope"))
+	if len(scopes) == 0 {
+		redirectWithOAuthError(w, r, redirectURI, state, "invalid_scope")
+		return authorizeRequest{}, false
+	}
+	for _, scope := range scopes {
+		if !delegatedScopes[scope] {
+			redirectWithOAuthError(w, r, redirectURI, state, "invalid_scope")
+			return authorizeRequest{}, false
+		}
+	}
+
+	return authorizeRequest{
+		ClientName: client.Name,
+		ClientID: client.ID,
+		RedirectURI: redirectURI,
+		Scope: strings.Join(scopes, " "),
+		Scopes: scopes,
+		State: state,
+		CodeChallenge: values.Get("code_challenge"),
+	}, true
+}
+
+func (cfg *apiConfig) HandleOAuthClientCreate(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeTokens)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	type parameters struct {
+		Name		string		`json:"name"`
+		RedirectURIs	[]string	`json:"redirect_uris"`
+		Confidential	bool		`json:"confidential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+
+	if params.Name == "" || len(params.RedirectURIs) == 0 {
+		respondWithError(w, 400, "name and redirect_uris are required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			respondWithError(w, 400, "invalid redirect uri: "+uri)
+			return
+		}
+	}
+
+	client, secret, err := cfg.db.CreateOAuthClient(userID, params.Name, params.RedirectURIs, params.Confidential)
+	if err != nil {
+		respondWithError(w, 500, "error creating client")
+		return
+	}
+
+	ret := struct {
+		OAuthClient
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{
+		OAuthClient: client,
+		ClientSecret: secret,
+	}
+	respondWithJSON(w, 201, ret)
+}
+
+func (cfg *apiConfig) HandleOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, ok := cfg.parseAuthorizeRequest(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err := consentPage.Execute(w, req)
+	if err != nil {
+		log.Printf("error rendering consent page: %v", err)
+	}
+}
+
+func (cfg *apiConfig) HandleOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+	req, ok := cfg.parseAuthorizeRequest(w, r, r.PostForm)
+	if !ok {
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		redirectWithOAuthError(w, r, req.RedirectURI, req.State, "access_denied")
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(r.PostForm.Get("email"))
+	if err == nil {
+		_, err = verifyPassword(user.Password, r.PostForm.Get("password"))
+	}
+	if err != nil {
+		req.Error = "Incorrect email or password."
+		w.Header().Add("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		consentPage.Execute(w, req)
+		return
+	}
+
+	code, err := cfg.db.CreateAuthorizationCode(AuthorizationCode{
+		ClientID: req.ClientID,
+		UserID: user.ID,
+		RedirectURI: req.RedirectURI,
+		Scopes: req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		redirectWithOAuthError(w, r, req.RedirectURI, req.State, "server_error")
+		return
+	}
+
+	values := url.Values{}
+	values.Set("code", code)
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+	http.Redirect(w, r, appendQuery(req.RedirectURI, values), http.StatusFound)
+}
+
+func (cfg *apiConfig) HandleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, ok := cfg.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	var grant OAuthGrant
+	var refreshToken string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		grant, refreshToken, err = cfg.db.ExchangeAuthorizationCode(
+			r.PostForm.Get("code"),
+			client.ID,
+			r.PostForm.Get("redirect_uri"),
+			r.PostForm.Get("code_verifier"),
+		)
+	case "refresh_token":
+		grant, refreshToken, err = cfg.db.RefreshOAuthGrant(r.PostForm.Get("refresh_token"), client.ID)
+	default:
+		respondWithOAuthError(w, 400, "unsupported_grant_type", "")
+		return
+	}
+	if err == errInvalidGrant {
+		respondWithOAuthError(w, 400, "invalid_grant", "")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", "")
+		return
+	}
+
+	claims, err := cfg.newClaims(grant.UserID, oauthAccessTokenSeconds)
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", "")
+		return
+	}
+	claims.ID = grant.ID
+	claims.Scope = strings.Join(grant.Scopes, " ")
+	claims.ClientID = client.ID
+	accessToken, err := cfg.signJWT(claims)
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", "")
+		return
+	}
+
+	ret := struct {
+		AccessToken	string `json:"access_token"`
+		TokenType	string `json:"token_type"`
+		ExpiresIn	int    `json:"expires_in"`
+		RefreshToken	string `json:"refresh_token"`
+		Scope		string `json:"scope"`
+	}{
+		AccessToken: accessToken,
+		TokenType: "Bearer",
+		ExpiresIn: oauthAccessTokenSeconds,
+		RefreshToken: refreshToken,
+		Scope: claims.Scope,
+	}
+	respondWithJSON(w, 200, ret)
+}
+
+func (cfg *apiConfig) HandleOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "")
+		return
+	}
+
+	client, ok := cfg.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	// The token may be a refresh token or one of our access tokens, in
+	// which case the grant it belongs to is revoked.
+	token := r.PostForm.Get("token")
+	grantID := ""
+	claims, err := parseClaims(token)
+	if err == nil && claims.ClientID == client.ID {
+		grantID = claims.ID
+	}
+
+	err = cfg.db.RevokeOAuthGrant(client.ID, token, grantID)
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", "")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateOAuthClient identifies the calling client from HTTP Basic
+// credentials or the client_id and client_secret form fields.
+func (cfg *apiConfig) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (OAuthClientCredential, bool) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.db.GetOAuthClient(clientID)
+	if err != nil || !client.verifySecret(clientSecret) {
+		respondWithOAuthError(w, 401, "invalid_client", "")
+		return OAuthClientCredential{}, false
+	}
+	return client, true
+}
@@ -48,7 +48,7 @@ func (cfg *apiConfig) HandlePolkaWebhooks(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = cfg.db.UpgradeUser(params.Data.UserID)
+	err = cfg.db.UpgradeUser(params.Data.UserID, newAuditEvent(r, 0, "user.upgrade", userTarget(params.Data.UserID)))
 	if err != nil {
 		
 		if err.Error() == "user not found" {
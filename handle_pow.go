@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) HandlePowChallenge(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	if route == "" {
+		route = powRouteSignup
+	}
+	if route != powRouteSignup && route != powRouteLogin {
+		respondWithError(w, 400, "unknown route")
+		return
+	}
+
+	id, challenge, err := cfg.pow.issue(route)
+	if err != nil {
+		respondWithError(w, 500, "error creating challenge")
+		return
+	}
+
+	ret := struct {
+		Challenge	string		`json:"challenge"`
+		Route		string		`json:"route"`
+		Algorithm	string		`json:"algorithm"`
+		Difficulty	int		`json:"difficulty"`
+		ExpiresAt	time.Time	`json:"expires_at"`
+	}{
+		Challenge: id,
+		Route: challenge.Route,
+		Algorithm: "sha256",
+		Difficulty: challenge.Difficulty,
+		ExpiresAt: challenge.ExpiresAt,
+	}
+	respondWithJSON(w, 200, ret)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+func (cfg *apiConfig) HandleRechirp(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	rechirp, err := cfg.db.Rechirp(chirpID, userID)
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+	if errors.Is(err, errAlreadyRechirped) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "error rechirping")
+		return
+	}
+	respondWithJSON(w, 201, rechirp)
+}
+
+func (cfg *apiConfig) HandleUndoRechirp(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	err = cfg.db.Unrechirp(chirpID, userID)
+	if errors.Is(err, errNotRechirped) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "error undoing rechirp")
+		return
+	}
+	respondWithJSON(w, 204, "")
+}
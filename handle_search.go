@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// HandleSearchChirps serves full-text search over chirps, most relevant
+// first. q supports plain words, "quoted phrases" and prefix* queries, all
+// of which must match.
+func (cfg *apiConfig) HandleSearchChirps(w http.ResponseWriter, r *http.Request) {
+	clauses, err := parseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	limit := defaultChirpPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			respondWithError(w, 400, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxChirpPageSize)
+	}
+
+	chirps, err := cfg.db.GetChirpsByID(cfg.search.search(clauses), cfg.viewerID(r))
+	if err != nil {
+		log.Printf("error loading search results: %v", err)
+		respondWithError(w, 500, "error loading chirps")
+		return
+	}
+	respondWithJSON(w, 200, chirps[:min(limit, len(chirps))])
+}
@@ -7,68 +7,91 @@ import (
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func ValidateJWT(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", errors.New("authorization header missing")	
-	}
-
-	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
-	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-		log.Println("Error in Split at validateToken")
-		return "", errors.New("invalid authorization header format")	
-	}
-	tokenString := tokenParts[1]
+func parseClaims(tokenString string) (*chirpyClaims, error) {
+	claims := chirpyClaims{}
 
-	claims := jwt.RegisteredClaims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func (token *jwt.Token) (interface{}, error) {
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func (token *jwt.Token) (interface{}, error) {
 		return []byte(os.Getenv("JWT_SECRET")), nil
 	})
 
 	if err != nil  {
 		log.Println("Error in ParseWithClaims at validateToken")
-		return "", err
+		return nil, err
 	}
 
-	userIDString, err := token.Claims.GetSubject()
+	return &claims, nil
+}
+
+
+func (cfg *apiConfig) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenString, err := bearerOrCookie(r, refreshCookieName)
 	if err != nil {
-		return "", err
+		respondWithAuthError(w, err)
+		return
 	}
 
-	return userIDString, nil
+	refreshToken, _ := cfg.db.GetRefreshToken(tokenString)
+	err = cfg.db.RevokeToken(tokenString)
+	if err != nil {
+		respondWithError(w, 500, "internal error")
+		return
+	}
+	if r.Header.Get("Authorization") == "" {
+		clearSessionCookies(w)
+	}
+	if refreshToken != nil {
+		cfg.audit(newAuditEvent(r, refreshToken.UserID, "token.revoke", userTarget(refreshToken.UserID)))
+	}
+	respondWithJSON(w, 204, "")
 }
 
+// HandleLogoutAll signs the user out of every session: refresh tokens are
+// revoked and access tokens already issued stop working. Personal access
+// tokens are left alone; they are revoked individually.
+func (cfg *apiConfig) HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeTokens)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
 
-func (cfg *apiConfig) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
-	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
-	tokenString := tokenParts[1]
-
-	err := cfg.db.RevokeToken(tokenString)
+	err = cfg.db.RevokeSessions(userID)
 	if err != nil {
 		respondWithError(w, 500, "internal error")
 		return
 	}
+	if r.Header.Get("Authorization") == "" {
+		clearSessionCookies(w)
+	}
+	cfg.audit(newAuditEvent(r, userID, "user.logout_all", userTarget(userID)))
 	respondWithJSON(w, 204, "")
 }
 
 func (cfg * apiConfig) HandleRefreshJWT(w http.ResponseWriter, r *http.Request) {
-	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
-	tokenString := tokenParts[1]
+	tokenString, err := bearerOrCookie(r, refreshCookieName)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
 
 	refreshToken, err := cfg.db.GetRefreshToken(tokenString)
 	if err != nil {
+		cfg.auditUnauthenticatedFailure(newAuditEvent(r, 0, "token.refresh", ""))
 		respondWithError(w, 401, "invalid token")
 		return
 	}
 
+	_, err = cfg.checkAccount(refreshToken.UserID)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
 	newJWT, err := cfg.generateJWT((*refreshToken).UserID, 60*60)
 	if err != nil {
 		respondWithError(w, 500, "problem generating token")
@@ -82,6 +105,12 @@ func (cfg * apiConfig) HandleRefreshJWT(w http.ResponseWriter, r *http.Request)
 	payload := JWT{
 		NewToken: newJWT,
 	}
+	cfg.audit(newAuditEvent(r, refreshToken.UserID, "token.refresh", userTarget(refreshToken.UserID)))
+	if r.Header.Get("Authorization") == "" {
+		setAccessCookie(w, newJWT, 60*60)
+		respondWithJSON(w, 200, struct{}{})
+		return
+	}
 	respondWithJSON(w, 200, payload)
 
 
@@ -94,6 +123,9 @@ func (cfg *apiConfig) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
 		Password	 string `json:"password"`
 		Email		 string `json:"email"`
 		ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+		// Session "cookie" returns the tokens as cookies for browsers
+		// instead of in the body.
+		Session		 string `json:"session,omitempty"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -105,18 +137,43 @@ func (cfg *apiConfig) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !cfg.checkPow(w, r, powRouteLogin, params.Email) {
+		return
+	}
+
 	user, err := cfg.db.GetUserByEmail(params.Email)
 	if err != nil {
+		cfg.pow.recordLoginFailure(params.Email)
+		event := newAuditEvent(r, 0, "user.login", "")
+		event.Details = map[string]string{"email": emailKey(params.Email), "reason": "unknown email"}
+		cfg.auditUnauthenticatedFailure(event)
 		respondWithError(w, 404, "user not found")
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword(user.Password, []byte(params.Password))
+	needsRehash, err := verifyPassword(user.Password, params.Password)
 	if err != nil {
-		log.Println("Error at bcrypt.CompareHashAndPassword:", err)
+		log.Println("Error at verifyPassword:", err)
+		cfg.pow.recordLoginFailure(params.Email)
+		event := newAuditEvent(r, 0, "user.login", userTarget(user.ID))
+		event.Details = map[string]string{"reason": "wrong password"}
+		cfg.auditUnauthenticatedFailure(event)
 		respondWithError(w, 401, "unauthorized")
 		return
 	}
+	if needsRehash {
+		cfg.rehashPassword(user.ID, user.Password, params.Password)
+	}
+	cfg.pow.resetLoginFailures(params.Email)
+
+	if user.Moderation.blocked(time.Now().UTC()) {
+		event := newAuditEvent(r, user.ID, "user.login", userTarget(user.ID))
+		event.Outcome = auditFailure
+		event.Details = map[string]string{"reason": "account suspended"}
+		cfg.audit(event)
+		respondWithError(w, 403, user.Moderation.blockedError().Error())
+		return
+	}
 
 	// No expiration time passed or time passed is over 24 hours
 	if params.ExpiresInSeconds == 0 || params.ExpiresInSeconds > 60*60 {
@@ -125,13 +182,28 @@ func (cfg *apiConfig) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
 
 	signedJWT, err := cfg.generateJWT(user.ID, params.ExpiresInSeconds)
 	if err != nil {
-		respondWithError(w, 500, err.Error())
+		log.Printf("error generating token for user %d: %v", user.ID, err)
+		respondWithError(w, 500, "error generating token")
+		return
 	}
 
 	refreshToken, err := cfg.db.CreateRefreshToken(user.ID)
 	if err != nil {
-		respondWithError(w, 500, "error creating refres token")
-		log.Fatal(err)
+		log.Printf("error creating refresh token for user %d: %v", user.ID, err)
+		respondWithError(w, 500, "error creating refresh token")
+		return
+	}
+
+	cfg.audit(newAuditEvent(r, user.ID, "user.login", userTarget(user.ID)))
+
+	if params.Session == "cookie" {
+		err = setSessionCookies(w, signedJWT, params.ExpiresInSeconds, refreshToken)
+		if err != nil {
+			respondWithError(w, 500, "error creating session")
+			return
+		}
+		respondWithJSON(w, 200, user.User)
+		return
 	}
 
 	ret := struct {
@@ -152,17 +224,64 @@ func (cfg *apiConfig) HandleUserLogin(w http.ResponseWriter, r *http.Request) {
 	
 }
 
+// rehashPassword upgrades a user's stored hash to the current policy after
+// a successful login, unless current, the hash the password was checked
+// against, has been replaced since. Failing to do so doesn't fail the
+// login.
+func (cfg *apiConfig) rehashPassword(userID int, current []byte, password string) {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		log.Printf("error rehashing password for user %d: %v", userID, err)
+		return
+	}
+	err = cfg.db.SetPasswordHash(userID, current, hashed)
+	if err != nil && !errors.Is(err, errPasswordChanged) {
+		log.Printf("error storing rehashed password for user %d: %v", userID, err)
+	}
+}
+
+type chirpyClaims struct {
+	jwt.RegisteredClaims
+	// Scope and ClientID are only set on tokens issued to OAuth clients,
+	// whose ID is kept in the token ID claim.
+	Scope		string	`json:"scope,omitempty"`
+	ClientID	string	`json:"client_id,omitempty"`
+	// ImpersonatorID is the admin who minted an impersonation token for
+	// the subject.
+	ImpersonatorID	int	`json:"impersonator_id,omitempty"`
+	// TokenVersion is the subject's token version when the token was
+	// issued; bumping the user's version invalidates it.
+	TokenVersion	int	`json:"ver"`
+}
+
 func (cfg *apiConfig) generateJWT(userID int, expiresInSeconds int) (string, error) {
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256, 
-		jwt.RegisteredClaims{
+	claims, err := cfg.newClaims(userID, expiresInSeconds)
+	if err != nil {
+		return "", err
+	}
+	return cfg.signJWT(claims)
+}
+
+// newClaims returns the claims for an access token for userID, stamped with
+// the user's current token version.
+func (cfg *apiConfig) newClaims(userID int, expiresInSeconds int) (chirpyClaims, error) {
+	user, err := cfg.db.GetUserCredential(userID)
+	if err != nil {
+		return chirpyClaims{}, err
+	}
+	return chirpyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer: "chirpy",
 			IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Second*time.Duration(expiresInSeconds))),
 			Subject: strconv.Itoa(userID),
 		},
-	)
+		TokenVersion: user.TokenVersion,
+	}, nil
+}
 
+func (cfg *apiConfig) signJWT(claims chirpyClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	secretKey := []byte(os.Getenv("JWT_SECRET"))
 	signedJWT, err := token.SignedString(secretKey)
@@ -173,9 +292,9 @@ func (cfg *apiConfig) generateJWT(userID int, expiresInSeconds int) (string, err
 }
 
 func (cfg *apiConfig) HandleUserUpdate(w http.ResponseWriter, r *http.Request) {
-	userIDString, err := ValidateJWT(r)
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithAuthError(w, err)
 		return
 	}
 
@@ -191,12 +310,25 @@ func (cfg *apiConfig) HandleUserUpdate(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 400, "bad request")
 		return
 	}
-	userID, _ := strconv.Atoi(userIDString)
-	user, err := cfg.db.UpdateUser(userID, params.Email, params.Password)
+	email, err := normalizeEmail(params.Email)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if violations := cfg.validatePassword(params.Password, email); len(violations) > 0 {
+		respondWithPasswordViolations(w, violations)
+		return
+	}
+	user, err := cfg.db.UpdateUser(userID, email, params.Password)
+	if errors.Is(err, errEmailTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, 500, "could not update credentials")
 		return
 	}
+	cfg.audit(newAuditEvent(r, userID, "user.password_change", userTarget(userID)))
 	respondWithJSON(w, 200, user)
 }
 
@@ -204,6 +336,14 @@ func (cfg *apiConfig) HandleUserCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email string `json:"email"`
+		Handle string `json:"handle,omitempty"`
+		InviteCode string `json:"invite_code,omitempty"`
+	}
+
+	mode := registrationMode()
+	if mode == registrationClosed {
+		respondWithError(w, 403, "registration is closed")
+		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -214,11 +354,45 @@ func (cfg *apiConfig) HandleUserCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.CreateUser(params.Email, params.Password)
+	if !cfg.checkPow(w, r, powRouteSignup, "") {
+		return
+	}
+
+	if mode == registrationInviteOnly && params.InviteCode == "" {
+		respondWithError(w, 403, "an invite code is required to register")
+		return
+	}
+
+	email, err := normalizeEmail(params.Email)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if params.Handle != "" {
+		err = validateHandle(params.Handle)
+		if err != nil {
+			respondWithHandleError(w, err)
+			return
+		}
+	}
+	if violations := cfg.validatePassword(params.Password, email); len(violations) > 0 {
+		respondWithPasswordViolations(w, violations)
+		return
+	}
+	user, err := cfg.db.CreateUser(email, params.Password, params.Handle, params.InviteCode)
+	if errors.Is(err, errEmailTaken) || errors.Is(err, errHandleTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidInvite) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, 500, "Error creating user.")
 		return
 	}
+	cfg.pow.recordSignup()
 	respondWithJSON(w, 201, user)
 }
 
@@ -231,3 +405,222 @@ func (cfg *apiConfig) HandleUserList(w http.ResponseWriter, r *http.Request) {
 
 	respondWithJSON(w, 200, users)
 }
+
+func (cfg *apiConfig) HandleUserDelete(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+
+	user, err := cfg.db.GetUserCredential(userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	_, err = verifyPassword(user.Password, params.Password)
+	if err != nil {
+		event := newAuditEvent(r, userID, "user.delete", userTarget(userID))
+		event.Outcome = auditFailure
+		event.Details = map[string]string{"reason": "wrong password"}
+		cfg.audit(event)
+		respondWithError(w, 401, "unauthorized")
+		return
+	}
+
+	// CHIRP_DELETION_POLICY decides what happens to a deleted account's
+	// chirps: "delete" (the default) removes them, "anonymize" keeps them
+	// without an author.
+	anonymize := os.Getenv("CHIRP_DELETION_POLICY") == "anonymize"
+	err = cfg.db.DeleteUser(userID, anonymize, newAuditEvent(r, userID, "user.delete", userTarget(userID)))
+	if err != nil {
+		respondWithError(w, 500, "error deleting user")
+		return
+	}
+	if !anonymize {
+		cfg.search.removeAuthor(userID)
+	}
+	respondWithJSON(w, 204, "")
+}
+
+// HandleUserPatch applies a JSON merge patch (RFC 7396) to the current user.
+// Only the fields present in the patch change; changing the email or password
+// also requires current_password.
+func (cfg *apiConfig) HandleUserPatch(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.authenticate(r, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	patch := map[string]json.RawMessage{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&patch)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+
+	var email, handle, password, currentPassword *string
+	for field, raw := range patch {
+		var target **string
+		switch field {
+		case "email":
+			target = &email
+		case "handle":
+			target = &handle
+		case "password":
+			target = &password
+		case "current_password":
+			target = &currentPassword
+		default:
+			respondWithError(w, 400, field+" cannot be changed")
+			return
+		}
+		err = json.Unmarshal(raw, target)
+		if err != nil {
+			respondWithError(w, 400, field+" must be a string")
+			return
+		}
+		// A null member removes the field in a merge patch, and none of
+		// these can be removed.
+		if *target == nil {
+			respondWithError(w, 400, field+" cannot be null")
+			return
+		}
+	}
+
+	user, err := cfg.db.GetUserCredential(userID)
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	if email != nil || password != nil {
+		if currentPassword == nil {
+			respondWithError(w, 400, "current_password is required to change email or password")
+			return
+		}
+		_, err = verifyPassword(user.Password, *currentPassword)
+		if err != nil {
+			event := newAuditEvent(r, userID, "user.update", userTarget(userID))
+			event.Outcome = auditFailure
+			event.Details = map[string]string{"reason": "wrong password"}
+			cfg.audit(event)
+			respondWithError(w, 401, "unauthorized")
+			return
+		}
+	}
+
+	if email != nil {
+		normalized, err := normalizeEmail(*email)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		email = &normalized
+	}
+
+	if handle != nil {
+		err = validateHandle(*handle)
+		if err != nil {
+			respondWithHandleError(w, err)
+			return
+		}
+	}
+
+	var hashed []byte
+	if password != nil {
+		effectiveEmail := user.Email
+		if email != nil {
+			effectiveEmail = *email
+		}
+		if violations := cfg.validatePassword(*password, effectiveEmail); len(violations) > 0 {
+			respondWithPasswordViolations(w, violations)
+			return
+		}
+		hashed, err = hashPassword(*password)
+		if err != nil {
+			respondWithError(w, 500, "could not update credentials")
+			return
+		}
+	}
+
+	updated, err := cfg.db.PatchUser(userID, email, handle, hashed)
+	if errors.Is(err, errEmailTaken) || errors.Is(err, errHandleTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "could not update user")
+		return
+	}
+	if email != nil {
+		cfg.audit(newAuditEvent(r, userID, "user.email_change", userTarget(userID)))
+	}
+	if password != nil {
+		cfg.audit(newAuditEvent(r, userID, "user.password_change", userTarget(userID)))
+	}
+	if handle != nil {
+		event := newAuditEvent(r, userID, "user.handle_change", userTarget(userID))
+		event.Details = map[string]string{"old": user.Handle, "new": *handle}
+		cfg.audit(event)
+	}
+	respondWithJSON(w, 200, updated)
+}
+
+// HandleUserAppeal lets a moderated user leave a note for the admins. It
+// takes the user's credentials directly because suspended and banned users
+// can't log in.
+func (cfg *apiConfig) HandleUserAppeal(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email		string `json:"email"`
+		Password	string `json:"password"`
+		Note		string `json:"note"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "bad request")
+		return
+	}
+	if params.Note == "" || len(params.Note) > 2000 {
+		respondWithError(w, 400, "note must be between 1 and 2000 characters")
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err == nil {
+		_, err = verifyPassword(user.Password, params.Password)
+	}
+	if err != nil {
+		respondWithError(w, 401, "unauthorized")
+		return
+	}
+	if !user.Moderation.blocked(time.Now().UTC()) {
+		respondWithError(w, 400, "account is not suspended")
+		return
+	}
+
+	err = cfg.db.SetAppealNote(user.ID, params.Note)
+	if err != nil {
+		respondWithError(w, 500, "error saving appeal")
+		return
+	}
+	cfg.audit(newAuditEvent(r, user.ID, "user.appeal", userTarget(user.ID)))
+	respondWithJSON(w, 204, "")
+}
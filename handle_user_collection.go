@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// HandleUserCollection serves GET /api/users/{user}/{collection}, where user
+// is an ID or handle. The collections share one route because separate
+// patterns would conflict with GET /api/users/export/{exportID}.
+func (cfg *apiConfig) HandleUserCollection(w http.ResponseWriter, r *http.Request) {
+	switch r.PathValue("collection") {
+	case "mentions":
+		cfg.HandleUserMentions(w, r)
+	case "likes":
+		cfg.HandleUserLikes(w, r)
+	default:
+		respondWithError(w, 404, "not found")
+	}
+}
+
+// HandleUserMentions lists the chirps mentioning a user. It takes the same
+// filtering, sorting and paging parameters as GET /api/chirps.
+func (cfg *apiConfig) HandleUserMentions(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.db.GetUserByIDOrHandle(r.PathValue("user"))
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	cfg.serveChirpList(w, r, mentionFilter(user.ID))
+}
+
+// HandleUserLikes lists the chirps a user likes. It takes the same
+// filtering, sorting and paging parameters as GET /api/chirps.
+func (cfg *apiConfig) HandleUserLikes(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.db.GetUserByIDOrHandle(r.PathValue("user"))
+	if err != nil {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+	liked, err := cfg.db.likedByFilter(user.ID)
+	if err != nil {
+		log.Printf("error loading likes of user %d: %v", user.ID, err)
+		respondWithError(w, 500, "error loading chirps")
+		return
+	}
+	cfg.serveChirpList(w, r, liked)
+}
+
+func respondWithHandleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errHandleTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	respondWithError(w, 400, err.Error())
+}
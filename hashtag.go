@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxHashtagLength = 100
+
+// ChirpEntities are the structured parts of a chirp's body, found when it
+// is posted. Offsets are byte offsets into the body, End exclusive.
+type ChirpEntities struct {
+	Hashtags []HashtagEntity `json:"hashtags"`
+	Mentions []MentionEntity `json:"mentions"`
+}
+
+func (dbs *DBStructure) chirpEntities(body string) ChirpEntities {
+	return ChirpEntities{
+		Hashtags: extractHashtags(body),
+		Mentions: dbs.extractMentions(body),
+	}
+}
+
+type HashtagEntity struct {
+	// Tag is the hashtag as written, without the #.
+	Tag	string	`json:"tag"`
+	Start	int	`json:"start"`
+	End	int	`json:"end"`
+}
+
+// extractHashtags finds #tags in body. A tag starts with a # that doesn't
+// follow a letter or digit, runs over letters, digits and underscores, and
+// can't be only digits, so "#1" or "C#" aren't tags.
+func extractHashtags(body string) []HashtagEntity {
+	hashtags := []HashtagEntity{}
+	prev := ' '
+	for i, r := range body {
+		if r != '#' || isHashtagRune(prev) {
+			prev = r
+			continue
+		}
+		prev = r
+
+		end := i + 1
+		hasLetter := false
+		for end < len(body) {
+			next, size := utf8.DecodeRuneInString(body[end:])
+			if !isHashtagRune(next) {
+				break
+			}
+			hasLetter = hasLetter || unicode.IsLetter(next)
+			end += size
+		}
+		tag := body[i+1 : end]
+		if hasLetter && utf8.RuneCountInString(tag) <= maxHashtagLength {
+			hashtags = append(hashtags, HashtagEntity{Tag: tag, Start: i, End: end})
+		}
+	}
+	return hashtags
+}
+
+func isHashtagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || unicode.Is(unicode.Mn, r)
+}
+
+// hashtagKey is the form hashtags are looked up and counted by, so #Café,
+// #cafe and #CAFE are the same tag.
+func hashtagKey(tag string) string {
+	return normalizeText(strings.TrimPrefix(tag, "#"))
+}
+
+// validHashtag reports whether tag, with or without the #, is a whole
+// hashtag.
+func validHashtag(tag string) bool {
+	tag = "#" + strings.TrimPrefix(tag, "#")
+	hashtags := extractHashtags(tag)
+	return len(hashtags) == 1 && hashtags[0].End == len(tag)
+}
+
+func chirpHasHashtag(chirp Chirp) bool {
+	return len(chirp.Entities.Hashtags) > 0
+}
+
+// hashtagFilter matches chirps tagged with tag.
+func hashtagFilter(tag string) func(Chirp) bool {
+	key := hashtagKey(tag)
+	return func(chirp Chirp) bool {
+		for _, hashtag := range chirp.Entities.Hashtags {
+			if hashtagKey(hashtag.Tag) == key {
+				return true
+			}
+		}
+		return false
+	}
+}
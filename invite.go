@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	registrationOpen	= "open"
+	registrationInviteOnly	= "invite-only"
+	registrationClosed	= "closed"
+)
+
+var (
+	errInvalidInvite	= errors.New("invite code is invalid, expired or used up")
+	errInviteQuota		= errors.New("invite quota reached")
+)
+
+// Invite lets MaxUses people register while registration is invite-only.
+type Invite struct {
+	Code		string		`json:"code"`
+	CreatorID	int		`json:"creator_id"`
+	MaxUses		int		`json:"max_uses"`
+	Uses		int		`json:"uses"`
+	UsedBy		[]int		`json:"used_by"`
+	CreatedAt	time.Time	`json:"created_at"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+}
+
+func (invite Invite) usable(now time.Time) bool {
+	if invite.ExpiresAt != nil && now.After(*invite.ExpiresAt) {
+		return false
+	}
+	return invite.Uses < invite.MaxUses
+}
+
+// registrationMode reads REGISTRATION_MODE: open (the default), invite-only
+// or closed.
+func registrationMode() string {
+	switch mode := os.Getenv("REGISTRATION_MODE"); mode {
+	case registrationInviteOnly, registrationClosed:
+		return mode
+	default:
+		return registrationOpen
+	}
+}
+
+// inviteQuota is how many people a user may have outstanding invitations
+// for at once, counting every remaining use of their usable invites, from
+// INVITE_QUOTA and INVITE_QUOTA_CHIRPY_RED. Admins have no quota, reported
+// as -1.
+func inviteQuota(user User) int {
+	if user.IsAdmin {
+		return -1
+	}
+	key, quota := "INVITE_QUOTA", 5
+	if user.IsChirpyRed {
+		key, quota = "INVITE_QUOTA_CHIRPY_RED", 25
+	}
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n >= 0 {
+		quota = n
+	}
+	return quota
+}
+
+func (db *DB) CreateInvite(creatorID int, maxUses int, expiresAt *time.Time) (Invite, error) {
+	code, err := randomHex(10)
+	if err != nil {
+		return Invite{}, err
+	}
+	invite := Invite{
+		Code: strings.ToUpper(code),
+		CreatorID: creatorID,
+		MaxUses: maxUses,
+		UsedBy: []int{},
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+
+	err = db.update(func(dbs *DBStructure) error {
+		creator, ok := dbs.Users[creatorID]
+		if !ok {
+			return errors.New("user not found")
+		}
+		if quota := inviteQuota(creator.User); quota >= 0 {
+			outstanding := 0
+			for _, other := range dbs.Invites {
+				if other.CreatorID == creatorID && other.usable(invite.CreatedAt) {
+					outstanding += other.MaxUses - other.Uses
+				}
+			}
+			if outstanding+invite.MaxUses > quota {
+				return errInviteQuota
+			}
+		}
+		dbs.Invites[invite.Code] = invite
+		return nil
+	})
+	if err != nil {
+		return Invite{}, err
+	}
+	return invite, nil
+}
+
+func (db *DB) GetInvites(creatorID int) ([]Invite, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return []Invite{}, err
+	}
+	invites := []Invite{}
+	for _, invite := range dbs.Invites {
+		if invite.CreatorID == creatorID {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.Before(invites[j].CreatedAt)
+	})
+	return invites, nil
+}
+
+// redeemInvite uses up one use of an invite for a new user as part of the
+// caller's update and returns who created it.
+func (dbs *DBStructure) redeemInvite(code string, userID int) (int, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	invite, ok := dbs.Invites[code]
+	if !ok || !invite.usable(time.Now().UTC()) {
+		return 0, errInvalidInvite
+	}
+	invite.Uses++
+	invite.UsedBy = append(invite.UsedBy, userID)
+	dbs.Invites[code] = invite
+	return invite.CreatorID, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// Like records that userID likes a chirp, or a rechirp's original. Liking a
+// chirp twice changes nothing.
+func (db *DB) Like(chirpID int, userID int) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbs *DBStructure) error {
+		target, ok := dbs.Chirps[chirpID]
+		if !ok || !dbs.visibleTo(target, userID) {
+			return errChirpNotFound
+		}
+		chirp, ok = dbs.Chirps[dbs.originalChirpID(chirpID)]
+		if !ok || !dbs.visibleTo(chirp, userID) {
+			return errChirpNotFound
+		}
+		if _, liked := dbs.Likes[chirp.ID][userID]; !liked {
+			if dbs.Likes[chirp.ID] == nil {
+				dbs.Likes[chirp.ID] = map[int]time.Time{}
+			}
+			dbs.Likes[chirp.ID][userID] = time.Now().UTC()
+			chirp.LikeCount++
+			dbs.Chirps[chirp.ID] = chirp
+		}
+		chirp = dbs.viewChirp(chirp, userID)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Unlike takes back userID's like, if any.
+func (db *DB) Unlike(chirpID int, userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		chirpID = dbs.originalChirpID(chirpID)
+		if _, ok := dbs.Chirps[chirpID]; !ok {
+			return errChirpNotFound
+		}
+		dbs.unlike(chirpID, userID)
+		return nil
+	})
+}
+
+// unlike is Unlike as part of the caller's update.
+func (dbs *DBStructure) unlike(chirpID int, userID int) {
+	if _, liked := dbs.Likes[chirpID][userID]; !liked {
+		return
+	}
+	delete(dbs.Likes[chirpID], userID)
+	if len(dbs.Likes[chirpID]) == 0 {
+		delete(dbs.Likes, chirpID)
+	}
+	if chirp, ok := dbs.Chirps[chirpID]; ok {
+		chirp.LikeCount--
+		dbs.Chirps[chirpID] = chirp
+	}
+}
+
+// likedByFilter matches chirps userID likes. It reads the likes as they
+// were when the filter was made.
+func (db *DB) likedByFilter(userID int) (func(Chirp) bool, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	liked := map[int]bool{}
+	for chirpID, users := range dbs.Likes {
+		if _, ok := users[userID]; ok {
+			liked[chirpID] = true
+		}
+	}
+	return func(chirp Chirp) bool { return liked[chirp.ID] }, nil
+}
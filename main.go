@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 
@@ -17,11 +19,44 @@ const path string = "./database.json"
 type apiConfig struct {
 	fileserverHits int
 	db *DB
+	breachedPasswords *breachedPasswordList
+	pow *powGuard
+	search *searchIndex
+	trends *trendCache
+	auditThrottle *auditThrottle
 }
 
 
 func main() {
 	godotenv.Load()
+	fsck := flag.Bool("fsck", false, "check the database for problems and exit")
+	makeAdmin := flag.String("make-admin", "", "grant admin rights to the user with this email and exit")
+	flag.Parse()
+
+	if *fsck {
+		db, err := NewDB(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(runFsck(db))
+	}
+	if *makeAdmin != "" {
+		db, err := NewDB(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user, err := db.GetUserByEmail(*makeAdmin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = db.SetAdmin(user.ID, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("user %d (%s) is now an admin\n", user.ID, user.Email)
+		return
+	}
+
 	serveMux := http.NewServeMux()
 	server := http.Server{
 		Handler: serveMux,
@@ -35,23 +70,75 @@ func main() {
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		db: db,	
+		pow: newPowGuard(),
+		trends: newTrendCache(),
+		auditThrottle: newAuditThrottle(),
+	}
+
+	apiCfg.search, err = buildSearchIndex(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go apiCfg.trends.run(db)
+
+	if breachedPath := os.Getenv("BREACHED_PASSWORDS_FILE"); breachedPath != "" {
+		apiCfg.breachedPasswords, err = loadBreachedPasswords(breachedPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	serveMux.Handle("/app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
 	serveMux.HandleFunc("GET /api/healthz", apiCfg.HandleHealthz)
 	serveMux.HandleFunc("GET /admin/metrics", apiCfg.HandleFileServerHits )
+	serveMux.HandleFunc("GET /admin/audit", apiCfg.HandleAuditLog)
+	serveMux.HandleFunc("GET /admin/users/{userID}/moderation", apiCfg.HandleUserModeration)
+	serveMux.HandleFunc("POST /admin/users/{userID}/suspend", apiCfg.handleModerateUser(moderationSuspend))
+	serveMux.HandleFunc("POST /admin/users/{userID}/ban", apiCfg.handleModerateUser(moderationBan))
+	serveMux.HandleFunc("POST /admin/users/{userID}/shadowban", apiCfg.handleModerateUser(moderationShadowban))
+	serveMux.HandleFunc("POST /admin/users/{userID}/reinstate", apiCfg.handleModerateUser(moderationReinstate))
+	serveMux.HandleFunc("POST /admin/users/{userID}/impersonate", apiCfg.HandleImpersonate)
 	serveMux.HandleFunc("/api/reset", apiCfg.HandleResetFileServerHits)
 	serveMux.HandleFunc("POST /api/chirps", apiCfg.HandleCreateChirp)
 	serveMux.HandleFunc("GET /api/chirps", apiCfg.HandleGetChirps)
-	serveMux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.HandleCreateChirp)
+	serveMux.HandleFunc("GET /api/chirps/search", apiCfg.HandleSearchChirps)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.HandleGetChirp)
+	serveMux.HandleFunc("PUT /api/chirps/{chirpID}", apiCfg.HandleChirpEdit)
 	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.HandleChirpDelete)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}/history", apiCfg.HandleChirpHistory)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}/thread", apiCfg.HandleChirpThread)
+	serveMux.HandleFunc("POST /api/chirps/{chirpID}/rechirp", apiCfg.HandleRechirp)
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/rechirp", apiCfg.HandleUndoRechirp)
+	serveMux.HandleFunc("POST /api/chirps/{chirpID}/like", apiCfg.HandleLike)
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/like", apiCfg.HandleUnlike)
+	serveMux.HandleFunc("GET /api/hashtags/{tag}/chirps", apiCfg.HandleHashtagChirps)
+	serveMux.HandleFunc("GET /api/trends", apiCfg.HandleTrends)
+	serveMux.HandleFunc("GET /api/challenges", apiCfg.HandlePowChallenge)
 	serveMux.HandleFunc("POST /api/users", apiCfg.HandleUserCreate)
 	serveMux.HandleFunc("PUT /api/users", apiCfg.HandleUserUpdate)
+	serveMux.HandleFunc("PATCH /api/users", apiCfg.HandleUserPatch)
+	serveMux.HandleFunc("DELETE /api/users", apiCfg.HandleUserDelete)
+	serveMux.HandleFunc("POST /api/users/appeal", apiCfg.HandleUserAppeal)
+	serveMux.HandleFunc("POST /api/users/export", apiCfg.HandleDataExportCreate)
+	serveMux.HandleFunc("GET /api/users/export/{exportID}", apiCfg.HandleDataExportStatus)
+	serveMux.HandleFunc("GET /api/exports/{exportID}/download", apiCfg.HandleDataExportDownload)
 	serveMux.HandleFunc("GET /api/users", apiCfg.HandleUserList)
+	serveMux.HandleFunc("GET /api/users/{user}/{collection}", apiCfg.HandleUserCollection)
 	serveMux.HandleFunc("POST /api/login", apiCfg.HandleUserLogin)
 	serveMux.HandleFunc("POST /api/refresh", apiCfg.HandleRefreshJWT)
 	serveMux.HandleFunc("POST /api/revoke", apiCfg.HandleRevokeToken)
+	serveMux.HandleFunc("POST /api/logout-all", apiCfg.HandleLogoutAll)
 	serveMux.HandleFunc("POST /api/polka/webhooks", apiCfg.HandlePolkaWebhooks)
+	serveMux.HandleFunc("POST /api/invites", apiCfg.HandleInviteCreate)
+	serveMux.HandleFunc("GET /api/invites", apiCfg.HandleInviteList)
+	serveMux.HandleFunc("POST /api/tokens", apiCfg.HandleAccessTokenCreate)
+	serveMux.HandleFunc("GET /api/tokens", apiCfg.HandleAccessTokenList)
+	serveMux.HandleFunc("DELETE /api/tokens/{tokenID}", apiCfg.HandleAccessTokenRevoke)
+	serveMux.HandleFunc("POST /api/oauth/clients", apiCfg.HandleOAuthClientCreate)
+	serveMux.HandleFunc("GET /api/oauth/authorize", apiCfg.HandleOAuthAuthorize)
+	serveMux.HandleFunc("POST /api/oauth/authorize", apiCfg.HandleOAuthConsent)
+	serveMux.HandleFunc("POST /api/oauth/token", apiCfg.HandleOAuthToken)
+	serveMux.HandleFunc("POST /api/oauth/revoke", apiCfg.HandleOAuthRevoke)
 
 	err = server.ListenAndServe()
 	if err != nil {
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// migrations bring databases written by older versions up to date. They run
+// in order at startup, each exactly once; new ones are only ever appended.
+var migrations = []func(dbs *DBStructure){
+	backfillChirpTimestamps,
+	backfillChirpEntities,
+	backfillMentions,
+	backfillConversations,
+}
+
+func (db *DB) migrate() error {
+	return db.update(func(dbs *DBStructure) error {
+		for dbs.SchemaVersion < len(migrations) {
+			log.Printf("migrating database to schema version %d", dbs.SchemaVersion+1)
+			migrations[dbs.SchemaVersion](dbs)
+			dbs.SchemaVersion++
+		}
+		return nil
+	})
+}
+
+// backfillChirpTimestamps stamps chirps from before timestamps were recorded
+// with the time of the migration, since when they were posted is unknown.
+// Sorting by time then falls back to ID order among them.
+func backfillChirpTimestamps(dbs *DBStructure) {
+	now := time.Now().UTC()
+	for id, chirp := range dbs.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+		}
+		if chirp.UpdatedAt.IsZero() {
+			chirp.UpdatedAt = chirp.CreatedAt
+		}
+		dbs.Chirps[id] = chirp
+	}
+}
+
+// backfillChirpEntities parses the entities of chirps posted before they
+// were recorded.
+func backfillChirpEntities(dbs *DBStructure) {
+	for id, chirp := range dbs.Chirps {
+		chirp.Entities = ChirpEntities{
+			Hashtags: extractHashtags(chirp.Body),
+		}
+		dbs.Chirps[id] = chirp
+	}
+}
+
+// backfillMentions resolves the @mentions in chirps posted before mentions
+// were recorded. Only handles taken at the time of the migration resolve.
+func backfillMentions(dbs *DBStructure) {
+	for id, chirp := range dbs.Chirps {
+		chirp.Entities.Mentions = dbs.extractMentions(chirp.Body)
+		dbs.Chirps[id] = chirp
+	}
+}
+
+// backfillConversations makes every existing chirp start its own
+// conversation, since none of them are replies.
+func backfillConversations(dbs *DBStructure) {
+	for id, chirp := range dbs.Chirps {
+		if chirp.ConversationID == 0 {
+			chirp.ConversationID = chirp.ID
+			dbs.Chirps[id] = chirp
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errAccountSuspended = errors.New("account suspended")
+
+// Moderation is the admin-controlled state of an account. It is stored with
+// the user's credentials rather than on User, so neither the user nor
+// anyone else can tell from the API that they are shadowbanned.
+type Moderation struct {
+	SuspendedUntil	*time.Time	`json:"suspended_until,omitempty"`
+	Banned		bool		`json:"banned"`
+	Shadowbanned	bool		`json:"shadowbanned"`
+	Reason		string		`json:"reason,omitempty"`
+	ModeratorID	int		`json:"moderator_id,omitempty"`
+	UpdatedAt	*time.Time	`json:"updated_at,omitempty"`
+	AppealNote	string		`json:"appeal_note,omitempty"`
+	AppealedAt	*time.Time	`json:"appealed_at,omitempty"`
+}
+
+// blocked reports whether the account may not log in or use the API.
+func (m Moderation) blocked(now time.Time) bool {
+	return m.Banned || (m.SuspendedUntil != nil && now.Before(*m.SuspendedUntil))
+}
+
+// blockedError describes why an account is blocked, for the user.
+func (m Moderation) blockedError() error {
+	if m.Banned {
+		return fmt.Errorf("%w: banned: %s", errAccountSuspended, m.Reason)
+	}
+	return fmt.Errorf("%w until %s: %s", errAccountSuspended, m.SuspendedUntil.Format(time.RFC3339), m.Reason)
+}
+
+const (
+	moderationSuspend	= "suspend"
+	moderationBan		= "ban"
+	moderationShadowban	= "shadowban"
+	moderationReinstate	= "reinstate"
+)
+
+// ModerateUser applies a moderation action to a user and records it in the
+// audit log. Suspending, banning and reinstating also revoke the user's
+// sessions, so neither their refresh tokens nor their access tokens keep
+// working.
+func (db *DB) ModerateUser(userID int, action string, duration time.Duration, reason string, audit AuditEvent) (Moderation, error) {
+	var moderation Moderation
+	err := db.update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("user not found")
+		}
+
+		now := time.Now().UTC()
+		moderation = user.Moderation
+		switch action {
+		case moderationSuspend:
+			until := now.Add(duration)
+			moderation.SuspendedUntil = &until
+		case moderationBan:
+			moderation.Banned = true
+		case moderationShadowban:
+			moderation.Shadowbanned = true
+		case moderationReinstate:
+			moderation = Moderation{AppealNote: moderation.AppealNote, AppealedAt: moderation.AppealedAt}
+		default:
+			return fmt.Errorf("unknown moderation action %q", action)
+		}
+		moderation.Reason = reason
+		moderation.ModeratorID = audit.ActorID
+		moderation.UpdatedAt = &now
+		user.Moderation = moderation
+		dbs.Users[userID] = user
+
+		if action != moderationShadowban {
+			dbs.revokeSessions(userID)
+		}
+
+		audit.Details = map[string]string{"reason": reason}
+		if action == moderationSuspend {
+			audit.Details["suspended_until"] = moderation.SuspendedUntil.Format(time.RFC3339)
+		}
+		dbs.appendAudit(audit)
+		return nil
+	})
+	if err != nil {
+		return Moderation{}, err
+	}
+	return moderation, nil
+}
+
+func (db *DB) SetAppealNote(userID int, note string) error {
+	return db.update(func(dbs *DBStructure) error {
+		user, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("user not found")
+		}
+		now := time.Now().UTC()
+		user.Moderation.AppealNote = note
+		user.Moderation.AppealedAt = &now
+		dbs.Users[userID] = user
+		return nil
+	})
+}
+
+// shadowbannedUsers returns the IDs of shadowbanned users.
+func (dbs *DBStructure) shadowbannedUsers() map[int]bool {
+	ids := map[int]bool{}
+	for id, user := range dbs.Users {
+		if user.Moderation.Shadowbanned {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// visibleTo reports whether viewerID may see a chirp: those by shadowbanned
+// users only exist for their authors.
+func (dbs *DBStructure) visibleTo(chirp Chirp, viewerID int) bool {
+	return chirp.AuthorID == viewerID || !dbs.Users[chirp.AuthorID].Moderation.Shadowbanned
+}
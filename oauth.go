@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+const (
+	oauthCodeLifetime		= 10 * time.Minute
+	oauthAccessTokenSeconds		= 60 * 60
+	oauthRefreshTokenLifetime	= 60 * 24 * time.Hour
+)
+
+// OAuthClient is a third-party application registered by a Chirpy user.
+// Public clients (mobile and single-page apps) have no secret and rely on
+// PKCE alone.
+type OAuthClient struct {
+	ID		string		`json:"client_id"`
+	Name		string		`json:"name"`
+	OwnerID		int		`json:"owner_id"`
+	RedirectURIs	[]string	`json:"redirect_uris"`
+	Confidential	bool		`json:"confidential"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type OAuthClientCredential struct {
+	OAuthClient
+	SecretHash string `json:"secret_hash"`
+}
+
+// AuthorizationCode is issued when a user approves a client on the consent
+// page and is exchanged exactly once at the token endpoint.
+type AuthorizationCode struct {
+	ClientID		string		`json:"client_id"`
+	UserID			int		`json:"user_id"`
+	RedirectURI		string		`json:"redirect_uri"`
+	Scopes			[]string	`json:"scopes"`
+	CodeChallenge		string		`json:"code_challenge"`
+	ExpiresAt		time.Time	`json:"expires_at"`
+}
+
+// OAuthGrant is the standing authorization behind a client's tokens. Access
+// tokens carry the grant ID, so revoking the grant invalidates them along
+// with the refresh token.
+type OAuthGrant struct {
+	ID			string		`json:"id"`
+	ClientID		string		`json:"client_id"`
+	UserID			int		`json:"user_id"`
+	Scopes			[]string	`json:"scopes"`
+	RefreshTokenHash	string		`json:"refresh_token_hash"`
+	ExpiresAt		time.Time	`json:"expires_at"`
+}
+
+var (
+	errInvalidClient	= errors.New("invalid client")
+	errInvalidGrant		= errors.New("invalid grant")
+)
+
+func (db *DB) CreateOAuthClient(ownerID int, name string, redirectURIs []string, confidential bool) (OAuthClient, string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+	secret := ""
+	if confidential {
+		secret, err = randomHex(32)
+		if err != nil {
+			return OAuthClient{}, "", err
+		}
+	}
+
+	client := OAuthClientCredential{
+		OAuthClient: OAuthClient{
+			ID: id,
+			Name: name,
+			OwnerID: ownerID,
+			RedirectURIs: redirectURIs,
+			Confidential: confidential,
+			CreatedAt: time.Now().UTC(),
+		},
+	}
+	if confidential {
+		client.SecretHash = hashAccessToken(secret)
+	}
+
+	err = db.update(func(dbs *DBStructure) error {
+		dbs.OAuthClients[client.ID] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+	return client.OAuthClient, secret, nil
+}
+
+func (db *DB) GetOAuthClient(clientID string) (OAuthClientCredential, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return OAuthClientCredential{}, err
+	}
+	client, ok := dbs.OAuthClients[clientID]
+	if !ok {
+		return OAuthClientCredential{}, errInvalidClient
+	}
+	return client, nil
+}
+
+func (db *DB) CreateAuthorizationCode(code AuthorizationCode) (string, error) {
+	codeString, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	code.ExpiresAt = time.Now().UTC().Add(oauthCodeLifetime)
+	err = db.update(func(dbs *DBStructure) error {
+		dbs.OAuthCodes[hashAccessToken(codeString)] = code
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return codeString, nil
+}
+
+// ExchangeAuthorizationCode redeems a code for a new grant. The code is
+// consumed even when verification fails, so a leaked code can't be retried.
+func (db *DB) ExchangeAuthorizationCode(codeString, clientID, redirectURI, codeVerifier string) (OAuthGrant, string, error) {
+	var grant OAuthGrant
+	var refreshToken string
+	var exchangeErr error
+	err := db.update(func(dbs *DBStructure) error {
+		key := hashAccessToken(codeString)
+		code, ok := dbs.OAuthCodes[key]
+		if !ok {
+			exchangeErr = errInvalidGrant
+			return nil
+		}
+		delete(dbs.OAuthCodes, key)
+
+		if code.ClientID != clientID || code.RedirectURI != redirectURI ||
+			time.Now().UTC().After(code.ExpiresAt) || !verifyCodeChallenge(code.CodeChallenge, codeVerifier) {
+			exchangeErr = errInvalidGrant
+			return nil
+		}
+
+		var err error
+		grant, refreshToken, err = newOAuthGrant(code.ClientID, code.UserID, code.Scopes)
+		if err != nil {
+			return err
+		}
+		dbs.OAuthGrants[grant.ID] = grant
+		return nil
+	})
+	if err != nil {
+		return OAuthGrant{}, "", err
+	}
+	if exchangeErr != nil {
+		return OAuthGrant{}, "", exchangeErr
+	}
+	return grant, refreshToken, nil
+}
+
+// RefreshOAuthGrant rotates a grant's refresh token and returns the new one.
+func (db *DB) RefreshOAuthGrant(refreshToken, clientID string) (OAuthGrant, string, error) {
+	var grant OAuthGrant
+	var newRefreshToken string
+	err := db.update(func(dbs *DBStructure) error {
+		hash := hashAccessToken(refreshToken)
+		for id, g := range dbs.OAuthGrants {
+			if g.RefreshTokenHash != hash {
+				continue
+			}
+			if g.ClientID != clientID || time.Now().UTC().After(g.ExpiresAt) {
+				return errInvalidGrant
+			}
+			var err error
+			newRefreshToken, err = randomHex(32)
+			if err != nil {
+				return err
+			}
+			g.RefreshTokenHash = hashAccessToken(newRefreshToken)
+			g.ExpiresAt = time.Now().UTC().Add(oauthRefreshTokenLifetime)
+			dbs.OAuthGrants[id] = g
+			grant = g
+			return nil
+		}
+		return errInvalidGrant
+	})
+	if err != nil {
+		return OAuthGrant{}, "", err
+	}
+	return grant, newRefreshToken, nil
+}
+
+func (db *DB) GetOAuthGrant(grantID string) (OAuthGrant, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return OAuthGrant{}, err
+	}
+	grant, ok := dbs.OAuthGrants[grantID]
+	if !ok || time.Now().UTC().After(grant.ExpiresAt) {
+		return OAuthGrant{}, errInvalidGrant
+	}
+	return grant, nil
+}
+
+// RevokeOAuthGrant removes the grant identified by either its refresh token
+// or its ID (the jti of an access token). Unknown tokens are not an error.
+func (db *DB) RevokeOAuthGrant(clientID string, refreshToken string, grantID string) error {
+	return db.update(func(dbs *DBStructure) error {
+		hash := hashAccessToken(refreshToken)
+		for id, g := range dbs.OAuthGrants {
+			if g.ClientID != clientID {
+				continue
+			}
+			if g.RefreshTokenHash == hash || id == grantID {
+				delete(dbs.OAuthGrants, id)
+			}
+		}
+		return nil
+	})
+}
+
+func newOAuthGrant(clientID string, userID int, scopes []string) (OAuthGrant, string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return OAuthGrant{}, "", err
+	}
+	refreshToken, err := randomHex(32)
+	if err != nil {
+		return OAuthGrant{}, "", err
+	}
+	grant := OAuthGrant{
+		ID: id,
+		ClientID: clientID,
+		UserID: userID,
+		Scopes: scopes,
+		RefreshTokenHash: hashAccessToken(refreshToken),
+		ExpiresAt: time.Now().UTC().Add(oauthRefreshTokenLifetime),
+	}
+	return grant, refreshToken, nil
+}
+
+func (client OAuthClientCredential) verifySecret(secret string) bool {
+	if !client.Confidential {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashAccessToken(secret))) == 1
+}
+
+func (client OAuthClientCredential) allowsRedirect(redirectURI string) bool {
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCodeChallenge checks a PKCE verifier against an S256 challenge.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
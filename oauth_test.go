@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testRedirectURI	= "https://client.example/callback"
+	testVerifier	= "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-verifier"
+)
+
+// newOAuthTestServer starts the OAuth endpoints, plus chirp creation to try
+// access tokens against, on a fresh database with one user and one public
+// client.
+func newOAuthTestServer(t *testing.T) (*httptest.Server, OAuthClient) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{db: db, search: newSearchIndex()}
+
+	user, err := db.CreateUser("alice@example.com", "correct horse battery", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, err := db.CreateOAuthClient(user.ID, "Test client", []string{testRedirectURI}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chirps", cfg.HandleCreateChirp)
+	mux.HandleFunc("GET /api/oauth/authorize", cfg.HandleOAuthAuthorize)
+	mux.HandleFunc("POST /api/oauth/authorize", cfg.HandleOAuthConsent)
+	mux.HandleFunc("POST /api/oauth/token", cfg.HandleOAuthToken)
+	mux.HandleFunc("POST /api/oauth/revoke", cfg.HandleOAuthRevoke)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, client
+}
+
+// noRedirects keeps the client from following the redirect back to the
+// (nonexistent) client application.
+func noRedirects(server *httptest.Server) *http.Client {
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize loads the consent page and approves it, returning the code the
+// client is redirected back with.
+func authorize(t *testing.T, server *httptest.Server, clientID string) string {
+	t.Helper()
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", clientID)
+	values.Set("redirect_uri", testRedirectURI)
+	values.Set("scope", "chirps:read chirps:write")
+	values.Set("state", "xyz")
+	values.Set("code_challenge", codeChallenge(testVerifier))
+	values.Set("code_challenge_method", "S256")
+
+	resp, err := server.Client().Get(server.URL + "/api/oauth/authorize?" + values.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("consent page: got status %d, want 200", resp.StatusCode)
+	}
+
+	values.Set("email", "alice@example.com")
+	values.Set("password", "correct horse battery")
+	values.Set("decision", "approve")
+	resp, err = noRedirects(server).PostForm(server.URL+"/api/oauth/authorize", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("consent: got status %d, want 302", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Query().Get("state"); got != "xyz" {
+		t.Fatalf("redirect state: got %q, want %q", got, "xyz")
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("redirect %s has no code", location)
+	}
+	return code
+}
+
+type tokenResponse struct {
+	AccessToken	string	`json:"access_token"`
+	RefreshToken	string	`json:"refresh_token"`
+	Scope		string	`json:"scope"`
+	Error		string	`json:"error"`
+}
+
+func postToken(t *testing.T, server *httptest.Server, values url.Values) (int, tokenResponse) {
+	t.Helper()
+	resp, err := server.Client().PostForm(server.URL+"/api/oauth/token", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ret := tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, ret
+}
+
+func exchangeCode(t *testing.T, server *httptest.Server, clientID, code, verifier string) (int, tokenResponse) {
+	t.Helper()
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("client_id", clientID)
+	values.Set("code", code)
+	values.Set("redirect_uri", testRedirectURI)
+	values.Set("code_verifier", verifier)
+	return postToken(t, server, values)
+}
+
+func refresh(t *testing.T, server *httptest.Server, clientID, refreshToken string) (int, tokenResponse) {
+	t.Helper()
+	values := url.Values{}
+	values.Set("grant_type", "refresh_token")
+	values.Set("client_id", clientID)
+	values.Set("refresh_token", refreshToken)
+	return postToken(t, server, values)
+}
+
+// createChirp tries an access token against an endpoint that needs
+// chirps:write and returns the status.
+func createChirp(t *testing.T, server *httptest.Server, accessToken string) int {
+	t.Helper()
+	req, err := http.NewRequest("POST", server.URL+"/api/chirps", strings.NewReader(`{"body":"hello from an app"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	server, client := newOAuthTestServer(t)
+
+	code := authorize(t, server, client.ID)
+	status, tokens := exchangeCode(t, server, client.ID, code, testVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("code exchange: got status %d (%s), want 200", status, tokens.Error)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("code exchange: missing tokens in %+v", tokens)
+	}
+	if tokens.Scope != "chirps:read chirps:write" {
+		t.Fatalf("code exchange: got scope %q", tokens.Scope)
+	}
+	if status := createChirp(t, server, tokens.AccessToken); status != http.StatusCreated {
+		t.Fatalf("using access token: got status %d, want 201", status)
+	}
+
+	// Codes can only be exchanged once.
+	status, tokens2 := exchangeCode(t, server, client.ID, code, testVerifier)
+	if status != http.StatusBadRequest || tokens2.Error != "invalid_grant" {
+		t.Fatalf("reused code: got status %d (%s), want 400 invalid_grant", status, tokens2.Error)
+	}
+
+	status, refreshed := refresh(t, server, client.ID, tokens.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("refresh: got status %d (%s), want 200", status, refreshed.Error)
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatal("refresh: refresh token was not rotated")
+	}
+	if status := createChirp(t, server, refreshed.AccessToken); status != http.StatusCreated {
+		t.Fatalf("using refreshed access token: got status %d, want 201", status)
+	}
+}
+
+func TestOAuthWrongVerifier(t *testing.T) {
+	server, client := newOAuthTestServer(t)
+
+	code := authorize(t, server, client.ID)
+	wrongVerifier := strings.Repeat("x", 50)
+	status, tokens := exchangeCode(t, server, client.ID, code, wrongVerifier)
+	if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+		t.Fatalf("wrong verifier: got status %d (%s), want 400 invalid_grant", status, tokens.Error)
+	}
+
+	// The failed attempt used the code up.
+	status, tokens = exchangeCode(t, server, client.ID, code, testVerifier)
+	if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+		t.Fatalf("code after failed exchange: got status %d (%s), want 400 invalid_grant", status, tokens.Error)
+	}
+}
+
+func TestOAuthRevokeGrant(t *testing.T) {
+	server, client := newOAuthTestServer(t)
+
+	code := authorize(t, server, client.ID)
+	status, tokens := exchangeCode(t, server, client.ID, code, testVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("code exchange: got status %d (%s), want 200", status, tokens.Error)
+	}
+
+	values := url.Values{}
+	values.Set("client_id", client.ID)
+	values.Set("token", tokens.RefreshToken)
+	resp, err := server.Client().PostForm(server.URL+"/api/oauth/revoke", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: got status %d, want 200", resp.StatusCode)
+	}
+
+	status, refreshed := refresh(t, server, client.ID, tokens.RefreshToken)
+	if status != http.StatusBadRequest || refreshed.Error != "invalid_grant" {
+		t.Fatalf("refresh after revocation: got status %d (%s), want 400 invalid_grant", status, refreshed.Error)
+	}
+	if status := createChirp(t, server, tokens.AccessToken); status != http.StatusUnauthorized {
+		t.Fatalf("access token after revocation: got status %d, want 401", status)
+	}
+}
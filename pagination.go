@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChirpPageSize	= 100
+	maxChirpPageSize	= 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// chirpCursor marks a position in a sorted list of chirps: the page after
+// the chirp with ID, or with Before the page before it. It records the
+// chirp's sort keys rather than its index, so pages stay put when chirps are
+// created or deleted between requests, even if that chirp is gone.
+type chirpCursor struct {
+	ID		int		`json:"id"`
+	CreatedAt	time.Time	`json:"c"`
+	UpdatedAt	time.Time	`json:"u"`
+	Before		bool		`json:"before,omitempty"`
+}
+
+func newChirpCursor(chirp Chirp, before bool) *chirpCursor {
+	return &chirpCursor{
+		ID: chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		Before: before,
+	}
+}
+
+// encode makes the cursor opaque to clients, who should only pass it back.
+func (c chirpCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeChirpCursor(s string) (chirpCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return chirpCursor{}, errInvalidCursor
+	}
+	cursor := chirpCursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.ID <= 0 {
+		return chirpCursor{}, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+// chirpPage is one page of chirps with the cursors for its neighbours,
+// which are nil at either end.
+type chirpPage struct {
+	Chirps	[]Chirp
+	Next	*chirpCursor
+	Prev	*chirpCursor
+}
+
+// paginateChirps cuts the page at cursor out of chirps, which must already
+// be sorted by less. A nil cursor means the first page.
+func paginateChirps(chirps []Chirp, less func(a, b Chirp) bool, cursor *chirpCursor, limit int) chirpPage {
+	start, end := 0, min(limit, len(chirps))
+	if cursor != nil {
+		mark := Chirp{ID: cursor.ID, CreatedAt: cursor.CreatedAt, UpdatedAt: cursor.UpdatedAt}
+		if cursor.Before {
+			end = sort.Search(len(chirps), func(i int) bool {
+				return !less(chirps[i], mark)
+			})
+			start = max(end-limit, 0)
+		} else {
+			start = sort.Search(len(chirps), func(i int) bool {
+				return less(mark, chirps[i])
+			})
+			end = min(start+limit, len(chirps))
+		}
+	}
+
+	page := chirpPage{Chirps: chirps[start:end]}
+	if end < len(chirps) && end > start {
+		page.Next = newChirpCursor(chirps[end-1], false)
+	}
+	if start > 0 && start < len(chirps) {
+		page.Prev = newChirpCursor(chirps[start], true)
+	}
+	return page
+}
+
+// pageParams reads the limit and cursor query parameters.
+func pageParams(r *http.Request) (int, *chirpCursor, error) {
+	limit := defaultChirpPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, nil, errors.New("limit must be a positive integer")
+		}
+		limit = min(n, maxChirpPageSize)
+	}
+
+	s := r.URL.Query().Get("cursor")
+	if s == "" {
+		return limit, nil, nil
+	}
+	cursor, err := decodeChirpCursor(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	return limit, &cursor, nil
+}
+
+// setPageLinks advertises the neighbouring pages in a Link header, keeping
+// the request's other query parameters.
+func setPageLinks(w http.ResponseWriter, r *http.Request, page chirpPage) {
+	links := []string{}
+	for _, link := range []struct {
+		rel	string
+		cursor	*chirpCursor
+	}{
+		{"next", page.Next},
+		{"prev", page.Prev},
+	} {
+		if link.cursor == nil {
+			continue
+		}
+		query := r.URL.Query()
+		query.Set("cursor", link.cursor.encode())
+		target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", target.String(), link.rel))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
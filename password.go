@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	hashBcrypt	= "bcrypt"
+	hashArgon2id	= "argon2id"
+)
+
+var errPasswordMismatch = errors.New("password does not match")
+
+// passwordHashPolicy describes how new password hashes are produced. Stored
+// hashes are self-describing, so changing the policy only affects hashes
+// created from then on; existing ones are upgraded as users log in.
+type passwordHashPolicy struct {
+	Algorithm	string
+	BcryptCost	int
+	Argon2Memory	uint32
+	Argon2Time	uint32
+	Argon2Threads	uint8
+}
+
+// currentHashPolicy reads the policy from PASSWORD_HASH_ALGORITHM,
+// BCRYPT_COST, ARGON2_MEMORY_KIB, ARGON2_TIME and ARGON2_THREADS.
+func currentHashPolicy() passwordHashPolicy {
+	policy := passwordHashPolicy{
+		Algorithm: hashBcrypt,
+		BcryptCost: bcrypt.DefaultCost,
+		Argon2Memory: 64 * 1024,
+		Argon2Time: 3,
+		Argon2Threads: 2,
+	}
+	if os.Getenv("PASSWORD_HASH_ALGORITHM") == hashArgon2id {
+		policy.Algorithm = hashArgon2id
+	}
+	if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+		policy.BcryptCost = cost
+	}
+	if memory, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY_KIB"), 10, 32); err == nil && memory >= 8 {
+		policy.Argon2Memory = uint32(memory)
+	}
+	if t, err := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32); err == nil && t > 0 {
+		policy.Argon2Time = uint32(t)
+	}
+	if threads, err := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8); err == nil && threads > 0 {
+		policy.Argon2Threads = uint8(threads)
+	}
+	return policy
+}
+
+// hashPassword returns an encoded hash of password under the current
+// policy: bcrypt's own "$2a$" format, or a PHC string for argon2id.
+func hashPassword(password string) ([]byte, error) {
+	policy := currentHashPolicy()
+	if policy.Algorithm == hashArgon2id {
+		return hashArgon2(password, policy)
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), policy.BcryptCost)
+}
+
+// verifyPassword checks password against an encoded hash. When it matches,
+// needsRehash reports whether the hash was made under an older policy.
+func verifyPassword(encoded []byte, password string) (needsRehash bool, err error) {
+	policy := currentHashPolicy()
+
+	if bytes.HasPrefix(encoded, []byte("$argon2id$")) {
+		params, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, errPasswordMismatch
+		}
+		return policy.Algorithm != hashArgon2id ||
+			params.Argon2Memory != policy.Argon2Memory ||
+			params.Argon2Time != policy.Argon2Time ||
+			params.Argon2Threads != policy.Argon2Threads, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword(encoded, []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, errPasswordMismatch
+		}
+		return false, err
+	}
+	cost, err := bcrypt.Cost(encoded)
+	if err != nil {
+		return false, err
+	}
+	return policy.Algorithm != hashBcrypt || cost != policy.BcryptCost, nil
+}
+
+func hashArgon2(password string, policy passwordHashPolicy) ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, policy.Argon2Time, policy.Argon2Memory, policy.Argon2Threads, 32)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		policy.Argon2Memory,
+		policy.Argon2Time,
+		policy.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(encoded), nil
+}
+
+func decodeArgon2(encoded []byte) (passwordHashPolicy, []byte, []byte, error) {
+	invalid := errors.New("invalid argon2id hash")
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 6 || parts[1] != hashArgon2id {
+		return passwordHashPolicy{}, nil, nil, invalid
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return passwordHashPolicy{}, nil, nil, invalid
+	}
+
+	params := passwordHashPolicy{Algorithm: hashArgon2id}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads)
+	if err != nil {
+		return passwordHashPolicy{}, nil, nil, invalid
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return passwordHashPolicy{}, nil, nil, invalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return passwordHashPolicy{}, nil, nil, invalid
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// passwordPolicy is the set of rules new passwords must satisfy.
+type passwordPolicy struct {
+	MinLength	int
+	// MaxBytes is the longest password the hashing algorithm accepts.
+	MaxBytes	int
+	RequireUpper	bool
+	RequireLower	bool
+	RequireDigit	bool
+	RequireSymbol	bool
+	ForbidEmail	bool
+}
+
+type passwordRuleViolation struct {
+	Rule	string `json:"rule"`
+	Message	string `json:"message"`
+}
+
+// currentPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_REQUIRE_UPPER, PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT,
+// PASSWORD_REQUIRE_SYMBOL and PASSWORD_FORBID_EMAIL. The maximum length
+// follows from the hashing algorithm: bcrypt only takes 72 bytes, and
+// argon2id is capped so nobody can make the server hash megabytes.
+func currentPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{
+		MinLength: 8,
+		MaxBytes: 72,
+		ForbidEmail: true,
+	}
+	if currentHashPolicy().Algorithm == hashArgon2id {
+		policy.MaxBytes = 1024
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+	policy.RequireUpper = envBool("PASSWORD_REQUIRE_UPPER", policy.RequireUpper)
+	policy.RequireLower = envBool("PASSWORD_REQUIRE_LOWER", policy.RequireLower)
+	policy.RequireDigit = envBool("PASSWORD_REQUIRE_DIGIT", policy.RequireDigit)
+	policy.RequireSymbol = envBool("PASSWORD_REQUIRE_SYMBOL", policy.RequireSymbol)
+	policy.ForbidEmail = envBool("PASSWORD_FORBID_EMAIL", policy.ForbidEmail)
+	return policy
+}
+
+// validatePassword checks password against the policy and the breached
+// password list and returns every rule it fails.
+func (cfg *apiConfig) validatePassword(password string, email string) []passwordRuleViolation {
+	policy := currentPasswordPolicy()
+	violations := []passwordRuleViolation{}
+
+	if len([]rune(password)) < policy.MinLength {
+		violations = append(violations, passwordRuleViolation{
+			Rule: "min_length",
+			Message: fmt.Sprintf("must be at least %d characters long", policy.MinLength),
+		})
+	}
+	if len(password) > policy.MaxBytes {
+		violations = append(violations, passwordRuleViolation{
+			Rule: "max_length",
+			Message: fmt.Sprintf("must be at most %d bytes long", policy.MaxBytes),
+		})
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		violations = append(violations, passwordRuleViolation{Rule: "uppercase", Message: "must contain an uppercase letter"})
+	}
+	if policy.RequireLower && !hasLower {
+		violations = append(violations, passwordRuleViolation{Rule: "lowercase", Message: "must contain a lowercase letter"})
+	}
+	if policy.RequireDigit && !hasDigit {
+		violations = append(violations, passwordRuleViolation{Rule: "digit", Message: "must contain a digit"})
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		violations = append(violations, passwordRuleViolation{Rule: "symbol", Message: "must contain a symbol"})
+	}
+
+	if policy.ForbidEmail && email != "" {
+		lowered := strings.ToLower(password)
+		local := emailKey(email)
+		if at := strings.LastIndex(local, "@"); at > 0 {
+			local = local[:at]
+		}
+		if strings.Contains(lowered, emailKey(email)) || (len(local) >= 3 && strings.Contains(lowered, local)) {
+			violations = append(violations, passwordRuleViolation{Rule: "contains_email", Message: "must not contain your email address"})
+		}
+	}
+
+	if cfg.breachedPasswords.contains(password) {
+		violations = append(violations, passwordRuleViolation{Rule: "breached", Message: "has appeared in a known data breach"})
+	}
+	return violations
+}
+
+func respondWithPasswordViolations(w http.ResponseWriter, violations []passwordRuleViolation) {
+	respondWithJSON(w, http.StatusBadRequest, struct {
+		Error		string			`json:"error"`
+		FailedRules	[]passwordRuleViolation	`json:"failed_rules"`
+	}{
+		Error: "password does not meet the password policy",
+		FailedRules: violations,
+	})
+}
+
+// breachedPasswordList holds SHA-1 hashes of known breached passwords,
+// bucketed by their first five hex characters the way k-anonymity range
+// APIs serve them, so the file can be built from downloaded range responses.
+type breachedPasswordList struct {
+	ranges map[string]map[string]bool
+}
+
+// loadBreachedPasswords reads a file with one uppercase or lowercase hex
+// SHA-1 per line, optionally followed by ":count". Blank lines and lines
+// starting with # are ignored.
+func loadBreachedPasswords(path string) (*breachedPasswordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &breachedPasswordList{ranges: map[string]map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("%s:%d: expected a SHA-1 hash", path, lineNumber)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: expected a SHA-1 hash", path, lineNumber)
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = map[string]bool{}
+		}
+		list.ranges[prefix][suffix] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (list *breachedPasswordList) contains(password string) bool {
+	if list == nil {
+		return false
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return list.ranges[hash[:5]][hash[5:]]
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proof-of-work challenges slow down scripted signups without relying on a
+// CAPTCHA service. A client fetches a challenge, finds a nonce for which
+// SHA-256("<challenge>:<nonce>") starts with the required number of zero
+// bits, and sends both with the guarded request in the X-PoW-Challenge and
+// X-PoW-Nonce headers. Challenges are single use and short lived.
+const (
+	powRouteSignup		= "signup"
+	powRouteLogin		= "login"
+	powChallengeLifetime	= 5 * time.Minute
+	powSignupWindow		= 10 * time.Minute
+	powLoginFailureWindow	= 15 * time.Minute
+	powMaxExtraDifficulty	= 8
+	// Anyone can make the guard remember a challenge or a failed login,
+	// so both are capped, forgetting the oldest entries first.
+	maxPowChallenges	= 10000
+	maxPowLoginFailureKeys	= 10000
+)
+
+var errPowRequired = errors.New("proof-of-work challenge required")
+
+type powChallenge struct {
+	Route		string
+	Difficulty	int
+	ExpiresAt	time.Time
+}
+
+// powGuard keeps issued challenges and the recent signups and failed logins
+// difficulty depends on. It lives in memory; a restart only forgets
+// outstanding challenges and recent history.
+type powGuard struct {
+	mux		*sync.Mutex
+	challenges	map[string]powChallenge
+	signups		[]time.Time
+	loginFailures	map[string][]time.Time
+}
+
+func newPowGuard() *powGuard {
+	return &powGuard{
+		mux: &sync.Mutex{},
+		challenges: map[string]powChallenge{},
+		loginFailures: map[string][]time.Time{},
+	}
+}
+
+// powRoutes reads POW_ROUTES, a comma-separated list of routes that always
+// need a solved challenge. It defaults to signup only.
+func powRoutes() map[string]bool {
+	value, ok := os.LookupEnv("POW_ROUTES")
+	if !ok {
+		value = powRouteSignup
+	}
+	routes := map[string]bool{}
+	for _, route := range strings.Split(value, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes[route] = true
+		}
+	}
+	return routes
+}
+
+// powBaseDifficulty reads POW_DIFFICULTY, in leading zero bits.
+func powBaseDifficulty() int {
+	if n, err := strconv.Atoi(os.Getenv("POW_DIFFICULTY")); err == nil && n >= 0 && n <= 32 {
+		return n
+	}
+	return 16
+}
+
+// powLoginFailureLimit reads POW_LOGIN_FAILURES: after this many recent
+// failed logins for an email, logging in to it needs a challenge too. 0
+// disables this.
+func powLoginFailureLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("POW_LOGIN_FAILURES")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+// powSignupBaseline reads POW_SIGNUP_BASELINE, the number of signups per
+// window considered normal.
+func powSignupBaseline() int {
+	if n, err := strconv.Atoi(os.Getenv("POW_SIGNUP_BASELINE")); err == nil && n > 0 {
+		return n
+	}
+	return 10
+}
+
+func (g *powGuard) issue(route string) (string, powChallenge, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", powChallenge{}, err
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	now := time.Now().UTC()
+	g.prune(now)
+
+	challenge := powChallenge{
+		Route: route,
+		Difficulty: g.difficulty(route),
+		ExpiresAt: now.Add(powChallengeLifetime),
+	}
+	if len(g.challenges) >= maxPowChallenges {
+		oldestID := ""
+		for otherID, other := range g.challenges {
+			if oldestID == "" || other.ExpiresAt.Before(g.challenges[oldestID].ExpiresAt) {
+				oldestID = otherID
+			}
+		}
+		delete(g.challenges, oldestID)
+	}
+	g.challenges[id] = challenge
+	return id, challenge, nil
+}
+
+// difficulty adds a bit for every doubling of recent signups over the
+// baseline, so a burst of registrations gets progressively more expensive.
+func (g *powGuard) difficulty(route string) int {
+	difficulty := powBaseDifficulty()
+	if route != powRouteSignup {
+		return difficulty
+	}
+	ratio := len(g.signups) / powSignupBaseline()
+	if ratio > 0 {
+		difficulty += min(bits.Len(uint(ratio)), powMaxExtraDifficulty)
+	}
+	return difficulty
+}
+
+// verify checks and consumes the challenge presented with r.
+func (g *powGuard) verify(r *http.Request, route string) error {
+	id := r.Header.Get("X-PoW-Challenge")
+	nonce := r.Header.Get("X-PoW-Nonce")
+	if id == "" || nonce == "" {
+		return errPowRequired
+	}
+
+	g.mux.Lock()
+	challenge, ok := g.challenges[id]
+	delete(g.challenges, id)
+	g.mux.Unlock()
+
+	if !ok || challenge.Route != route || time.Now().UTC().After(challenge.ExpiresAt) {
+		return errors.New("proof-of-work challenge is invalid or has expired")
+	}
+	sum := sha256.Sum256([]byte(id + ":" + nonce))
+	if leadingZeroBits(sum[:]) < challenge.Difficulty {
+		return errors.New("proof-of-work solution is incorrect")
+	}
+	return nil
+}
+
+func (g *powGuard) recordSignup() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.signups = append(g.signups, time.Now().UTC())
+}
+
+// recordLoginFailure remembers a failed login for an email. Only the last
+// few failures matter, so no more than the limit are kept per email.
+func (g *powGuard) recordLoginFailure(email string) {
+	limit := powLoginFailureLimit()
+	if limit == 0 {
+		return
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	now := time.Now().UTC()
+	key := emailKey(email)
+	if _, ok := g.loginFailures[key]; !ok && len(g.loginFailures) >= maxPowLoginFailureKeys {
+		g.prune(now)
+		if len(g.loginFailures) >= maxPowLoginFailureKeys {
+			g.forgetOldestLoginFailures()
+		}
+	}
+	failures := append(g.loginFailures[key], now)
+	g.loginFailures[key] = failures[max(len(failures)-limit, 0):]
+}
+
+// forgetOldestLoginFailures drops the email whose last failure is oldest.
+func (g *powGuard) forgetOldestLoginFailures() {
+	oldestKey := ""
+	var oldest time.Time
+	for key, failures := range g.loginFailures {
+		last := failures[len(failures)-1]
+		if oldestKey == "" || last.Before(oldest) {
+			oldestKey, oldest = key, last
+		}
+	}
+	delete(g.loginFailures, oldestKey)
+}
+
+func (g *powGuard) resetLoginFailures(email string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.loginFailures, emailKey(email))
+}
+
+// required reports whether a request to route, for the given email when
+// logging in, needs a solved challenge.
+func (g *powGuard) required(route string, email string) bool {
+	if powRoutes()[route] {
+		return true
+	}
+	if route != powRouteLogin {
+		return false
+	}
+	limit := powLoginFailureLimit()
+	if limit == 0 {
+		return false
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.prune(time.Now().UTC())
+	return len(g.loginFailures[emailKey(email)]) >= limit
+}
+
+func (g *powGuard) prune(now time.Time) {
+	for id, challenge := range g.challenges {
+		if now.After(challenge.ExpiresAt) {
+			delete(g.challenges, id)
+		}
+	}
+
+	keep := 0
+	for keep < len(g.signups) && now.Sub(g.signups[keep]) > powSignupWindow {
+		keep++
+	}
+	g.signups = g.signups[keep:]
+
+	for key, failures := range g.loginFailures {
+		keep := 0
+		for keep < len(failures) && now.Sub(failures[keep]) > powLoginFailureWindow {
+			keep++
+		}
+		if keep == len(failures) {
+			delete(g.loginFailures, key)
+		} else {
+			g.loginFailures[key] = failures[keep:]
+		}
+	}
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// checkPow enforces the challenge for route, writing the error response and
+// returning false when the request may not proceed.
+func (cfg *apiConfig) checkPow(w http.ResponseWriter, r *http.Request, route string, email string) bool {
+	if !cfg.pow.required(route, email) {
+		return true
+	}
+	err := cfg.pow.verify(r, route)
+	if err != nil {
+		respondWithError(w, http.StatusPreconditionRequired, err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The chirp query language lets GET /api/chirps?query= combine filters in a
+// single string, e.g.
+//
+//	from:42 since:2026-01-01 has:link -word "exact phrase" chirp*
+//
+// Terms are separated by spaces and must all match; a leading - negates a
+// term. Plain words, phrases and prefixes match like they do in search, and
+// #tag matches chirps with that hashtag.
+// Operators are:
+//
+//	from:<user ID>    chirps by that author
+//	since:<time>      created at or after an RFC 3339 time or date
+//	until:<time>      created before it
+//	has:<feature>     chirps containing a link, hashtag or mention
+//
+// Other words with a colon, such as URLs, are plain words.
+
+// queryError is a syntax error in a query. Pos is the 1-based position, in
+// characters, of the offending text.
+type queryError struct {
+	Pos	int
+	Msg	string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// queryOperators are the operator names, before the colon.
+var queryOperators = map[string]bool{
+	"from": true,
+	"since": true,
+	"until": true,
+	"has": true,
+}
+
+// hasFeatures are the values has: accepts.
+var hasFeatures = map[string]func(Chirp) bool{
+	"link": chirpHasLink,
+	"hashtag": chirpHasHashtag,
+	"mention": chirpHasMention,
+}
+
+type queryParser struct {
+	query	string
+	pos	int
+}
+
+// parseChirpQuery compiles a query into filters that must all hold for a
+// chirp to match.
+func parseChirpQuery(query string) ([]func(Chirp) bool, error) {
+	p := queryParser{query: query}
+	filters := []func(Chirp) bool{}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.query) {
+			return filters, nil
+		}
+		filter, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			filters = append(filters, filter)
+		}
+	}
+}
+
+func (p *queryParser) parseTerm() (func(Chirp) bool, error) {
+	start := p.pos
+	negate := p.query[p.pos] == '-'
+	if negate {
+		p.pos++
+		if p.pos >= len(p.query) || p.isSpace() {
+			return nil, p.errorAt(start, "- must be followed by a term")
+		}
+	}
+
+	var filter func(Chirp) bool
+	var err error
+	if p.query[p.pos] == '"' {
+		filter, err = p.parsePhrase()
+	} else {
+		filter, err = p.parseWordOrOperator()
+	}
+	if err != nil || filter == nil || !negate {
+		return filter, err
+	}
+	return func(chirp Chirp) bool { return !filter(chirp) }, nil
+}
+
+func (p *queryParser) parsePhrase() (func(Chirp) bool, error) {
+	start := p.pos
+	end := strings.IndexByte(p.query[start+1:], '"')
+	if end < 0 {
+		return nil, p.errorAt(start, "unterminated quoted phrase")
+	}
+	phrase := p.query[start+1 : start+1+end]
+	p.pos = start + end + 2
+
+	clause := searchClause{}
+	for _, token := range tokenize(phrase) {
+		clause.terms = append(clause.terms, token.term)
+	}
+	if len(clause.terms) == 0 {
+		return nil, p.errorAt(start, "empty phrase")
+	}
+	return clause.matchesChirp, nil
+}
+
+func (p *queryParser) parseWordOrOperator() (func(Chirp) bool, error) {
+	start := p.pos
+	for p.pos < len(p.query) && !p.isSpace() {
+		p.pos++
+	}
+	word := p.query[start:p.pos]
+	if len(word) > 1 && word[0] == '#' {
+		return hashtagFilter(word), nil
+	}
+
+	name, value, isOperator := strings.Cut(word, ":")
+	if !isOperator || !queryOperators[strings.ToLower(name)] {
+		return textFilter(word), nil
+	}
+	valuePos := start + len(name) + 1
+	if value == "" {
+		return nil, p.errorAt(valuePos, fmt.Sprintf("%s: needs a value", name))
+	}
+
+	switch strings.ToLower(name) {
+	case "from":
+		authorID, err := strconv.Atoi(value)
+		if err != nil || authorID <= 0 {
+			return nil, p.errorAt(valuePos, fmt.Sprintf("from: needs a user ID, not %q", value))
+		}
+		return func(chirp Chirp) bool { return chirp.AuthorID == authorID }, nil
+	case "since", "until":
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return nil, p.errorAt(valuePos, fmt.Sprintf("%s: %v", name, err))
+		}
+		if strings.ToLower(name) == "since" {
+			return func(chirp Chirp) bool { return !chirp.CreatedAt.Before(t) }, nil
+		}
+		return func(chirp Chirp) bool { return chirp.CreatedAt.Before(t) }, nil
+	default: // has
+		has, ok := hasFeatures[strings.ToLower(value)]
+		if !ok {
+			return nil, p.errorAt(valuePos, fmt.Sprintf("has: doesn't know %q", value))
+		}
+		return has, nil
+	}
+}
+
+// textFilter matches a plain word or prefix* the way search does. Words
+// without any letters or digits match everything.
+func textFilter(word string) func(Chirp) bool {
+	clauses, err := parseSearchQuery(word)
+	if err != nil {
+		return nil
+	}
+	return func(chirp Chirp) bool {
+		tokens := tokenize(chirp.Body)
+		for _, clause := range clauses {
+			if !clause.matchesTokens(tokens) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.query) && p.isSpace() {
+		p.pos++
+	}
+}
+
+func (p *queryParser) isSpace() bool {
+	r, _ := utf8.DecodeRuneInString(p.query[p.pos:])
+	return unicode.IsSpace(r)
+}
+
+func (p *queryParser) errorAt(offset int, msg string) error {
+	return &queryError{Pos: utf8.RuneCountInString(p.query[:offset]) + 1, Msg: msg}
+}
+
+func (c searchClause) matchesChirp(chirp Chirp) bool {
+	return c.matchesTokens(tokenize(chirp.Body))
+}
+
+// matchesTokens evaluates the clause against a single tokenized chirp,
+// without the index.
+func (c searchClause) matchesTokens(tokens []searchToken) bool {
+	if c.prefix != "" {
+		for _, token := range tokens {
+			if strings.HasPrefix(token.word, c.prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	for start := 0; start+len(c.terms) <= len(tokens); start++ {
+		found := true
+		for i, term := range c.terms {
+			if tokens[start+i].term != term {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func chirpHasLink(chirp Chirp) bool {
+	for _, field := range strings.Fields(chirp.Body) {
+		field = strings.ToLower(field)
+		if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") || strings.HasPrefix(field, "www.") {
+			return true
+		}
+	}
+	return false
+}
+
+func respondWithQueryError(w http.ResponseWriter, query string, err *queryError) {
+	respondWithJSON(w, http.StatusBadRequest, struct {
+		Error		string	`json:"error"`
+		Query		string	`json:"query"`
+		Position	int	`json:"position"`
+	}{
+		Error: err.Error(),
+		Query: query,
+		Position: err.Pos,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errQuotedChirpNotFound	= errors.New("the quoted chirp doesn't exist")
+	errAlreadyRechirped	= errors.New("already rechirped")
+	errNotRechirped		= errors.New("not rechirped")
+)
+
+// Rechirp reposts a chirp for userID. Rechirping a rechirp reposts the
+// original, and each user can only rechirp a chirp once.
+func (db *DB) Rechirp(chirpID int, userID int) (Chirp, error) {
+	var rechirp Chirp
+	err := db.update(func(dbs *DBStructure) error {
+		target, ok := dbs.Chirps[chirpID]
+		if !ok || !dbs.visibleTo(target, userID) {
+			return errChirpNotFound
+		}
+		original, ok := dbs.Chirps[dbs.originalChirpID(chirpID)]
+		if !ok || !dbs.visibleTo(original, userID) {
+			return errChirpNotFound
+		}
+		if _, ok := dbs.findRechirp(original.ID, userID); ok {
+			return errAlreadyRechirped
+		}
+
+		now := time.Now().UTC()
+		rechirp = Chirp{
+			ID: dbs.nextChirpID(),
+			AuthorID: userID,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Entities: dbs.chirpEntities(""),
+			RechirpOf: original.ID,
+		}
+		rechirp.ConversationID = rechirp.ID
+		dbs.Chirps[rechirp.ID] = rechirp
+		original.RechirpCount++
+		dbs.Chirps[original.ID] = original
+		rechirp = dbs.viewChirp(rechirp, userID)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return rechirp, nil
+}
+
+// Unrechirp undoes userID's rechirp of a chirp.
+func (db *DB) Unrechirp(chirpID int, userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		rechirpID, ok := dbs.findRechirp(dbs.originalChirpID(chirpID), userID)
+		if !ok {
+			return errNotRechirped
+		}
+		dbs.deleteChirp(rechirpID)
+		return nil
+	})
+}
+
+func (dbs *DBStructure) findRechirp(chirpID int, userID int) (int, bool) {
+	for id, chirp := range dbs.Chirps {
+		if chirp.RechirpOf == chirpID && chirp.AuthorID == userID {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// originalChirpID resolves a rechirp to the chirp it reposts.
+func (dbs *DBStructure) originalChirpID(chirpID int) int {
+	if chirp, ok := dbs.Chirps[chirpID]; ok && chirp.RechirpOf != 0 {
+		return chirp.RechirpOf
+	}
+	return chirpID
+}
+
+// viewChirp prepares a chirp for viewerID, who is 0 for anonymous requests:
+// it fills in the chirp a rechirp or quote refers to, if it still exists and
+// the viewer may see it, and whether the viewer liked them. Only one level
+// is embedded. Likes of a rechirp are those of its original. Likes and
+// rechirps by shadowbanned users only count for those users.
+func (dbs *DBStructure) viewChirp(chirp Chirp, viewerID int) Chirp {
+	hidden := dbs.shadowbannedUsers()
+	delete(hidden, viewerID)
+	setEngagement := func(chirp *Chirp) {
+		likedID := chirp.ID
+		if chirp.RechirpOf != 0 {
+			likedID = chirp.RechirpOf
+		}
+		chirp.LikeCount = 0
+		for userID := range dbs.Likes[likedID] {
+			if !hidden[userID] {
+				chirp.LikeCount++
+			}
+		}
+		if chirp.RechirpCount > 0 && len(hidden) > 0 {
+			for _, other := range dbs.Chirps {
+				if other.RechirpOf == chirp.ID && hidden[other.AuthorID] {
+					chirp.RechirpCount--
+				}
+			}
+		}
+		if viewerID != 0 {
+			_, liked := dbs.Likes[likedID][viewerID]
+			chirp.LikedByMe = &liked
+		}
+	}
+	embed := func(id int) *Chirp {
+		referenced, ok := dbs.Chirps[id]
+		if !ok || !dbs.visibleTo(referenced, viewerID) {
+			return nil
+		}
+		setEngagement(&referenced)
+		return &referenced
+	}
+	setEngagement(&chirp)
+	if chirp.RechirpOf != 0 {
+		chirp.RechirpedChirp = embed(chirp.RechirpOf)
+	}
+	if chirp.QuoteOf != 0 {
+		chirp.QuotedChirp = embed(chirp.QuoteOf)
+	}
+	return chirp
+}
@@ -69,6 +69,30 @@ func (db *DB) CreateRefreshToken(userID int) (*RefreshToken, error) {
 	return &newToken, nil
 }
 
+// RevokeSessions logs a user out everywhere: it revokes their refresh tokens
+// and bumps their token version so outstanding access tokens stop working.
+func (db *DB) RevokeSessions(userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		if _, ok := dbs.Users[userID]; !ok {
+			return errors.New("user not found")
+		}
+		dbs.revokeSessions(userID)
+		return nil
+	})
+}
+
+// revokeSessions is RevokeSessions as part of the caller's update.
+func (dbs *DBStructure) revokeSessions(userID int) {
+	for key, token := range dbs.RefreshTokens {
+		if token.UserID == userID {
+			delete(dbs.RefreshTokens, key)
+		}
+	}
+	user := dbs.Users[userID]
+	user.TokenVersion++
+	dbs.Users[userID] = user
+}
+
 func generateRefreshToken() (string, error) {
 	randBytes := make([]byte, 32)
 	_, err := rand.Read(randBytes)
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The search index maps normalized, stemmed terms to the chirps containing
+// them and where, so queries don't have to scan every chirp body. It lives
+// in memory, is rebuilt from the database at startup and is kept current as
+// chirps are created and deleted.
+
+// BM25 ranking parameters.
+const (
+	bm25K1	= 1.2
+	bm25B	= 0.75
+)
+
+var errEmptySearch = errors.New("search query is empty")
+
+type searchToken struct {
+	// word is the normalized token as written, term its stem.
+	word	string
+	term	string
+}
+
+type indexedChirp struct {
+	authorID	int
+	tokens		[]searchToken
+}
+
+type searchIndex struct {
+	mux	*sync.RWMutex
+	// terms maps each stem to the positions it appears at in each chirp.
+	terms	map[string]map[int][]int
+	// words counts unstemmed words in each chirp, for prefix queries.
+	words		map[string]map[int]int
+	chirps		map[int]indexedChirp
+	totalTokens	int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		mux: &sync.RWMutex{},
+		terms: map[string]map[int][]int{},
+		words: map[string]map[int]int{},
+		chirps: map[int]indexedChirp{},
+	}
+}
+
+// buildSearchIndex indexes every chirp in the database.
+func buildSearchIndex(db *DB) (*searchIndex, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	index := newSearchIndex()
+	for _, chirp := range dbs.Chirps {
+		index.add(chirp)
+	}
+	return index, nil
+}
+
+func (idx *searchIndex) add(chirp Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	idx.removeLocked(chirp.ID)
+
+	tokens := tokenize(chirp.Body)
+	for pos, token := range tokens {
+		if idx.terms[token.term] == nil {
+			idx.terms[token.term] = map[int][]int{}
+		}
+		idx.terms[token.term][chirp.ID] = append(idx.terms[token.term][chirp.ID], pos)
+		if idx.words[token.word] == nil {
+			idx.words[token.word] = map[int]int{}
+		}
+		idx.words[token.word][chirp.ID]++
+	}
+	idx.chirps[chirp.ID] = indexedChirp{authorID: chirp.AuthorID, tokens: tokens}
+	idx.totalTokens += len(tokens)
+}
+
+func (idx *searchIndex) remove(chirpID int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	idx.removeLocked(chirpID)
+}
+
+// removeAuthor drops every chirp by a user, e.g. when their account and
+// chirps are deleted.
+func (idx *searchIndex) removeAuthor(userID int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	for id, chirp := range idx.chirps {
+		if chirp.authorID == userID {
+			idx.removeLocked(id)
+		}
+	}
+}
+
+func (idx *searchIndex) removeLocked(chirpID int) {
+	chirp, ok := idx.chirps[chirpID]
+	if !ok {
+		return
+	}
+	for _, token := range chirp.tokens {
+		delete(idx.terms[token.term], chirpID)
+		if len(idx.terms[token.term]) == 0 {
+			delete(idx.terms, token.term)
+		}
+		delete(idx.words[token.word], chirpID)
+		if len(idx.words[token.word]) == 0 {
+			delete(idx.words, token.word)
+		}
+	}
+	idx.totalTokens -= len(chirp.tokens)
+	delete(idx.chirps, chirpID)
+}
+
+// searchClause is one part of a search query. Every clause must match.
+type searchClause struct {
+	// terms holds one stem for a plain word or several for a phrase.
+	terms	[]string
+	// prefix is set instead of terms for a prefix query such as chirp*.
+	prefix	string
+}
+
+// parseSearchQuery splits a query into words, "quoted phrases" and
+// prefix* queries.
+func parseSearchQuery(q string) ([]searchClause, error) {
+	clauses := []searchClause{}
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		var part string
+		phrase := q[0] == '"'
+		if phrase {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted phrase")
+			}
+			part, q = q[1:end+1], q[end+2:]
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				end = len(q)
+			}
+			part, q = q[:end], q[end:]
+		}
+
+		if !phrase && strings.HasSuffix(part, "*") {
+			tokens := tokenize(strings.TrimSuffix(part, "*"))
+			if len(tokens) == 0 {
+				continue
+			}
+			// Only the last word of e.g. "don't*" is a prefix.
+			for _, token := range tokens[:len(tokens)-1] {
+				clauses = append(clauses, searchClause{terms: []string{token.term}})
+			}
+			clauses = append(clauses, searchClause{prefix: tokens[len(tokens)-1].word})
+			continue
+		}
+
+		clause := searchClause{}
+		for _, token := range tokenize(part) {
+			clause.terms = append(clause.terms, token.term)
+		}
+		if len(clause.terms) > 0 {
+			clauses = append(clauses, clause)
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, errEmptySearch
+	}
+	return clauses, nil
+}
+
+// search returns the IDs of the chirps matching every clause, most relevant
+// first, ranked by BM25.
+func (idx *searchIndex) search(clauses []searchClause) []int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	var scores map[int]float64
+	for _, clause := range clauses {
+		matches := idx.matchClause(clause)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if score, ok := matches[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+	return ids
+}
+
+func (idx *searchIndex) matchClause(clause searchClause) map[int]float64 {
+	scores := map[int]float64{}
+	if clause.prefix != "" {
+		counts := map[int]int{}
+		for word, postings := range idx.words {
+			if !strings.HasPrefix(word, clause.prefix) {
+				continue
+			}
+			for id, n := range postings {
+				counts[id] += n
+			}
+		}
+		for id, n := range counts {
+			scores[id] = idx.bm25(id, n, len(counts))
+		}
+		return scores
+	}
+
+	first := idx.terms[clause.terms[0]]
+	for id := range first {
+		if len(clause.terms) > 1 && !idx.containsPhrase(id, clause.terms) {
+			continue
+		}
+		for _, term := range clause.terms {
+			postings := idx.terms[term]
+			scores[id] += idx.bm25(id, len(postings[id]), len(postings))
+		}
+	}
+	return scores
+}
+
+// containsPhrase reports whether the terms appear consecutively in a chirp.
+func (idx *searchIndex) containsPhrase(chirpID int, terms []string) bool {
+	for _, start := range idx.terms[terms[0]][chirpID] {
+		found := true
+		for offset, term := range terms[1:] {
+			if !containsInt(idx.terms[term][chirpID], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *searchIndex) bm25(chirpID int, termFreq int, docFreq int) float64 {
+	n := float64(len(idx.chirps))
+	idf := math.Log(1 + (n-float64(docFreq)+0.5)/(float64(docFreq)+0.5))
+	avgLen := float64(idx.totalTokens) / math.Max(n, 1)
+	length := float64(len(idx.chirps[chirpID].tokens))
+	tf := float64(termFreq)
+	return idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/math.Max(avgLen, 1)))
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize splits text into normalized words and their stems. Words are
+// runs of letters and digits.
+func tokenize(text string) []searchToken {
+	tokens := []searchToken{}
+	words := strings.FieldsFunc(normalizeText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		tokens = append(tokens, searchToken{word: word, term: stem(word)})
+	}
+	return tokens
+}
+
+// normalizeText case-folds text and removes the differences between
+// equivalent spellings that matter for search. It applies NFKD, which
+// splits accented letters into base letter and combining marks and maps
+// compatibility forms such as fullwidth letters and ligatures to their
+// plain equivalents, drops the marks, and spells out the few letters that
+// don't decompose, such as ß and ø.
+func normalizeText(text string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(text)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if folded, ok := foldedRunes[r]; ok {
+			b.WriteString(folded)
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// foldedRunes spells out letters that NFKD leaves alone.
+var foldedRunes = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th", 'ł': "l", 'ı': "i",
+}
+
+// stem strips common English inflections so that e.g. "chirps", "chirped"
+// and "chirping" all match "chirp". It is a much reduced Porter stemmer:
+// it only needs to map related words to the same stem, not to a real word.
+// Lengths are counted in runes, so words in other scripts are never cut in
+// the middle of a character.
+func stem(word string) string {
+	if utf8.RuneCountInString(word) <= 3 {
+		return word
+	}
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ies"):
+		word = strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+	case strings.HasSuffix(word, "s"):
+		word = strings.TrimSuffix(word, "s")
+	}
+
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		rest := strings.TrimSuffix(word, suffix)
+		if rest == word || utf8.RuneCountInString(rest) < 3 || !strings.ContainsAny(rest, "aeiouy") {
+			continue
+		}
+		word = rest
+		runes := []rune(word)
+		if n := len(runes); runes[n-1] == runes[n-2] && !strings.ContainsRune("aeiouslz", runes[n-1]) {
+			word = string(runes[:n-1])
+		}
+		break
+	}
+
+	if utf8.RuneCountInString(word) > 3 {
+		word = strings.TrimSuffix(word, "e")
+	}
+	if utf8.RuneCountInString(word) > 3 && strings.HasSuffix(word, "y") {
+		word = strings.TrimSuffix(word, "y") + "i"
+	}
+	return word
+}
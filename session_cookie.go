@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Browser sessions keep the access and refresh tokens in HttpOnly cookies
+// that scripts can't read. Because browsers attach those cookies to every
+// request, state-changing requests must also echo the readable CSRF cookie
+// in the X-CSRF-Token header (the double-submit pattern).
+const (
+	accessCookieName	= "chirpy_access"
+	refreshCookieName	= "chirpy_refresh"
+	csrfCookieName		= "chirpy_csrf"
+	csrfHeaderName		= "X-CSRF-Token"
+)
+
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+func setSessionCookies(w http.ResponseWriter, accessToken string, accessExpiresInSeconds int, refreshToken *RefreshToken) error {
+	csrfToken, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	setAccessCookie(w, accessToken, accessExpiresInSeconds)
+
+	refreshMaxAge := int(time.Until(refreshToken.ExpirationTime).Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name: refreshCookieName,
+		Value: refreshToken.Token,
+		Path: "/api",
+		MaxAge: refreshMaxAge,
+		HttpOnly: true,
+		Secure: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookieName,
+		Value: csrfToken,
+		Path: "/",
+		MaxAge: refreshMaxAge,
+		Secure: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func setAccessCookie(w http.ResponseWriter, accessToken string, expiresInSeconds int) {
+	http.SetCookie(w, &http.Cookie{
+		Name: accessCookieName,
+		Value: accessToken,
+		Path: "/",
+		MaxAge: expiresInSeconds,
+		HttpOnly: true,
+		Secure: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []struct {
+		name	string
+		path	string
+	}{
+		{accessCookieName, "/"},
+		{refreshCookieName, "/api"},
+		{csrfCookieName, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name: cookie.name,
+			Value: "",
+			Path: cookie.path,
+			MaxAge: -1,
+			HttpOnly: cookie.name != csrfCookieName,
+			Secure: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// bearerOrCookie returns the token from the Authorization header or, when
+// there is none, from the named session cookie. Cookie credentials on
+// state-changing requests must pass the CSRF check.
+func bearerOrCookie(r *http.Request, cookieName string) (string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return getAuthToken(r)
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil || cookie.Value == "" {
+		return "", errors.New("authorization header missing")
+	}
+	if !isSafeMethod(r.Method) {
+		err = checkCSRF(r)
+		if err != nil {
+			return "", err
+		}
+	}
+	return cookie.Value, nil
+}
+
+func checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return errCSRF
+	}
+	header := r.Header.Get(csrfHeaderName)
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return errCSRF
+	}
+	return nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
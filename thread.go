@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	defaultThreadDepth	= 3
+	maxThreadDepth		= 10
+)
+
+var (
+	errReplyParentNotFound	= errors.New("the chirp being replied to doesn't exist")
+	errChirpNotFound	= errors.New("chirp not found")
+)
+
+// ChirpTombstone remembers where a deleted chirp sat in its thread.
+type ChirpTombstone struct {
+	InReplyTo	int	`json:"in_reply_to"`
+	ConversationID	int	`json:"conversation_id"`
+}
+
+// ThreadEntry is a chirp in a thread view, or a placeholder for one that
+// was deleted or that the viewer can't see, so its replies still show
+// where they belong.
+type ThreadEntry struct {
+	ID		int		`json:"id"`
+	Unavailable	bool		`json:"unavailable,omitempty"`
+	Chirp		*Chirp		`json:"chirp,omitempty"`
+	Replies		[]ThreadEntry	`json:"replies,omitempty"`
+	// MoreReplies is set where the depth limit cut off further replies.
+	MoreReplies	bool		`json:"more_replies,omitempty"`
+}
+
+// Thread is the conversation around a chirp: the chain of chirps it replies
+// to, root first, and the replies to it nested up to the requested depth.
+type Thread struct {
+	ConversationID	int		`json:"conversation_id"`
+	Ancestors	[]ThreadEntry	`json:"ancestors"`
+	Chirp		Chirp		`json:"chirp"`
+	Replies		[]ThreadEntry	`json:"replies"`
+}
+
+func (db *DB) GetThread(chirpID int, depth int, viewerID int) (Thread, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return Thread{}, err
+	}
+	chirp, ok := dbs.Chirps[chirpID]
+	if !ok || !dbs.visibleTo(chirp, viewerID) {
+		return Thread{}, errChirpNotFound
+	}
+	thread := Thread{
+		ConversationID: chirp.ConversationID,
+		Chirp: dbs.viewChirp(chirp, viewerID),
+		Ancestors: []ThreadEntry{},
+	}
+
+	// Walk up, through tombstones, until the root or a chirp we know
+	// nothing more about.
+	seen := map[int]bool{chirpID: true}
+	for parentID := chirp.InReplyTo; parentID != 0 && !seen[parentID]; {
+		seen[parentID] = true
+		entry := ThreadEntry{ID: parentID}
+		next := 0
+		if parent, ok := dbs.Chirps[parentID]; ok {
+			next = parent.InReplyTo
+			if dbs.visibleTo(parent, viewerID) {
+				parent = dbs.viewChirp(parent, viewerID)
+				entry.Chirp = &parent
+			} else {
+				entry.Unavailable = true
+			}
+		} else {
+			entry.Unavailable = true
+			next = dbs.ChirpTombstones[parentID].InReplyTo
+		}
+		thread.Ancestors = append(thread.Ancestors, entry)
+		parentID = next
+	}
+	for i, j := 0, len(thread.Ancestors)-1; i < j; i, j = i+1, j-1 {
+		thread.Ancestors[i], thread.Ancestors[j] = thread.Ancestors[j], thread.Ancestors[i]
+	}
+
+	// Index the conversation's replies, including deleted ones, by parent.
+	children := map[int][]int{}
+	for id, other := range dbs.Chirps {
+		if other.ConversationID == chirp.ConversationID && other.InReplyTo != 0 {
+			children[other.InReplyTo] = append(children[other.InReplyTo], id)
+		}
+	}
+	for id, tombstone := range dbs.ChirpTombstones {
+		if tombstone.ConversationID == chirp.ConversationID && tombstone.InReplyTo != 0 {
+			children[tombstone.InReplyTo] = append(children[tombstone.InReplyTo], id)
+		}
+	}
+	for _, ids := range children {
+		sort.Ints(ids)
+	}
+
+	var replies func(parentID int, depth int) ([]ThreadEntry, bool)
+	replies = func(parentID int, depth int) ([]ThreadEntry, bool) {
+		ids := children[parentID]
+		if depth == 0 {
+			return nil, len(ids) > 0
+		}
+		entries := []ThreadEntry{}
+		for _, id := range ids {
+			entry := ThreadEntry{ID: id}
+			if reply, ok := dbs.Chirps[id]; ok {
+				if !dbs.visibleTo(reply, viewerID) {
+					continue
+				}
+				reply = dbs.viewChirp(reply, viewerID)
+				entry.Chirp = &reply
+			} else {
+				entry.Unavailable = true
+			}
+			entry.Replies, entry.MoreReplies = replies(id, depth-1)
+			// Deleted chirps only matter for the replies below them.
+			if entry.Unavailable && len(entry.Replies) == 0 && !entry.MoreReplies {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return entries, false
+	}
+	thread.Replies, _ = replies(chirpID, depth)
+	if thread.Replies == nil {
+		thread.Replies = []ThreadEntry{}
+	}
+	return thread, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Trending hashtags are the ones used most over the recent window relative
+// to how much they were used before it, so perennially popular tags don't
+// crowd out new ones. Each use counts less the older it is, halving every
+// half-life, and each author counts at most once per tag, so one account
+// posting a tag repeatedly can't make it trend. The result is cached and
+// recomputed in the background.
+const (
+	trendsBaselineWindows	= 7
+	maxTrends		= 50
+)
+
+type Trend struct {
+	Tag	string	`json:"tag"`
+	Score	float64	`json:"score"`
+	// Uses is how many chirps used the tag within the window.
+	Uses	int	`json:"uses"`
+}
+
+type trendCache struct {
+	mux		*sync.RWMutex
+	trends		[]Trend
+	computedAt	time.Time
+}
+
+func newTrendCache() *trendCache {
+	return &trendCache{mux: &sync.RWMutex{}, trends: []Trend{}}
+}
+
+// trendsWindow reads TRENDS_WINDOW, how far back uses count as recent.
+func trendsWindow() time.Duration {
+	return envDuration("TRENDS_WINDOW", 24*time.Hour)
+}
+
+// trendsHalfLife reads TRENDS_HALF_LIFE.
+func trendsHalfLife() time.Duration {
+	return envDuration("TRENDS_HALF_LIFE", 4*time.Hour)
+}
+
+// trendsInterval reads TRENDS_INTERVAL, how often trends are recomputed.
+func trendsInterval() time.Duration {
+	return envDuration("TRENDS_INTERVAL", 5*time.Minute)
+}
+
+func (c *trendCache) get() ([]Trend, time.Time) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.trends, c.computedAt
+}
+
+// run recomputes trends now and then every interval, forever.
+func (c *trendCache) run(db *DB) {
+	for {
+		c.refresh(db)
+		time.Sleep(trendsInterval())
+	}
+}
+
+func (c *trendCache) refresh(db *DB) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		log.Printf("error loading chirps for trends: %v", err)
+		return
+	}
+	now := time.Now().UTC()
+	trends := computeTrends(dbs, now)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.trends = trends
+	c.computedAt = now
+}
+
+func computeTrends(dbs DBStructure, now time.Time) []Trend {
+	window := trendsWindow()
+	halfLife := trendsHalfLife()
+	windowStart := now.Add(-window)
+	baselineStart := windowStart.Add(-trendsBaselineWindows * window)
+	shadowbanned := dbs.shadowbannedUsers()
+
+	type authorTag struct {
+		author	int
+		tag	string
+	}
+	// Weight of each author's latest use of each tag in the window.
+	recent := map[authorTag]float64{}
+	uses := map[string]int{}
+	baseline := map[string]map[int]bool{}
+
+	for _, chirp := range dbs.Chirps {
+		if shadowbanned[chirp.AuthorID] || chirp.CreatedAt.Before(baselineStart) || chirp.CreatedAt.After(now) {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, hashtag := range chirp.Entities.Hashtags {
+			tag := hashtagKey(hashtag.Tag)
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+
+			if chirp.CreatedAt.Before(windowStart) {
+				if baseline[tag] == nil {
+					baseline[tag] = map[int]bool{}
+				}
+				baseline[tag][chirp.AuthorID] = true
+				continue
+			}
+			age := now.Sub(chirp.CreatedAt)
+			weight := math.Pow(0.5, age.Hours()/halfLife.Hours())
+			key := authorTag{chirp.AuthorID, tag}
+			recent[key] = math.Max(recent[key], weight)
+			uses[tag]++
+		}
+	}
+
+	scores := map[string]float64{}
+	for key, weight := range recent {
+		scores[key.tag] += weight
+	}
+	trends := []Trend{}
+	for tag, score := range scores {
+		expected := float64(len(baseline[tag])) / trendsBaselineWindows
+		trends = append(trends, Trend{
+			Tag: tag,
+			Score: math.Round(score/(1+expected)*1000) / 1000,
+			Uses: uses[tag],
+		})
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Score != trends[j].Score {
+			return trends[i].Score > trends[j].Score
+		}
+		return trends[i].Tag < trends[j].Tag
+	})
+	return trends[:min(len(trends), maxTrends)]
+}
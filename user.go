@@ -4,10 +4,16 @@ type User struct {
 	ID int `json:"id"`
 	Email string `json:"email"`
 	IsChirpyRed bool `json:"is_chirpy_red"`
+	IsAdmin bool `json:"is_admin,omitempty"`
+	Handle string `json:"handle,omitempty"`
+	InvitedBy int `json:"invited_by,omitempty"`
 }
 
 type UserCredential struct {
 	User
 	Password []byte `json:"password"`
-
+	Moderation Moderation `json:"moderation"`
+	// TokenVersion is embedded in every access token issued to the user.
+	// Bumping it invalidates all of them at once.
+	TokenVersion int `json:"token_version"`
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minHandleLength	= 3
+	maxHandleLength	= 15
+)
+
+var (
+	errHandleTaken		= errors.New("handle is already taken")
+	errInvalidHandle	= errors.New("handles are 3 to 15 letters, digits or underscores and start with a letter")
+)
+
+// reservedHandles would be mistaken for other routes under /api/users.
+var reservedHandles = map[string]bool{
+	"admin": true,
+	"appeal": true,
+	"export": true,
+	"me": true,
+}
+
+// MentionEntity is an @handle in a chirp that named an existing user when
+// the chirp was posted. It keeps pointing at that user if they later change
+// their handle.
+type MentionEntity struct {
+	// Handle is the handle as written, without the @.
+	Handle	string	`json:"handle"`
+	UserID	int	`json:"user_id"`
+	Start	int	`json:"start"`
+	End	int	`json:"end"`
+}
+
+// validateHandle checks a handle's syntax. Handles start with a letter, so
+// they can't be confused with user IDs.
+func validateHandle(handle string) error {
+	if len(handle) < minHandleLength || len(handle) > maxHandleLength || !isASCIILetter(handle[0]) {
+		return errInvalidHandle
+	}
+	for i := 0; i < len(handle); i++ {
+		if !isHandleByte(handle[i]) {
+			return errInvalidHandle
+		}
+	}
+	if reservedHandles[handleKey(handle)] {
+		return errHandleTaken
+	}
+	return nil
+}
+
+// handleKey is the form handles are compared in; they are unique
+// regardless of case.
+func handleKey(handle string) string {
+	return strings.ToLower(handle)
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func isHandleByte(b byte) bool {
+	return isASCIILetter(b) || (b >= '0' && b <= '9') || b == '_'
+}
+
+// handleTaken reports whether a user other than exceptID has handle.
+func (dbs *DBStructure) handleTaken(handle string, exceptID int) bool {
+	key := handleKey(handle)
+	for id, user := range dbs.Users {
+		if id != exceptID && user.Handle != "" && handleKey(user.Handle) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) GetUserByHandle(handle string) (User, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	key := handleKey(handle)
+	for _, user := range dbs.Users {
+		if user.Handle != "" && handleKey(user.Handle) == key {
+			return user.User, nil
+		}
+	}
+	return User{}, errors.New("user not found")
+}
+
+// GetUserByIDOrHandle looks up a user by a path segment that may be either
+// their ID or their handle.
+func (db *DB) GetUserByIDOrHandle(ref string) (User, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return db.GetUser(id)
+	}
+	return db.GetUserByHandle(ref)
+}
+
+// extractMentions finds @handles in body that belong to a user. The @ must
+// not follow a letter, digit, underscore or dot, so email addresses aren't
+// mentions, and the handle must end at a character that can't be part of
+// one.
+func (dbs *DBStructure) extractMentions(body string) []MentionEntity {
+	users := map[string]int{}
+	for id, user := range dbs.Users {
+		if user.Handle != "" {
+			users[handleKey(user.Handle)] = id
+		}
+	}
+
+	mentions := []MentionEntity{}
+	for i := 0; i < len(body); i++ {
+		if body[i] != '@' {
+			continue
+		}
+		if i > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(body[:i])
+			if prev == '.' || (prev < utf8.RuneSelf && isHandleByte(byte(prev))) || isHashtagRune(prev) {
+				continue
+			}
+		}
+		end := i + 1
+		for end < len(body) && isHandleByte(body[end]) {
+			end++
+		}
+		handle := body[i+1 : end]
+		if userID, ok := users[handleKey(handle)]; ok && validateHandle(handle) == nil {
+			mentions = append(mentions, MentionEntity{Handle: handle, UserID: userID, Start: i, End: end})
+		}
+		i = end - 1
+	}
+	return mentions
+}
+
+func chirpHasMention(chirp Chirp) bool {
+	return len(chirp.Entities.Mentions) > 0
+}
+
+// mentionFilter matches chirps that mention userID.
+func mentionFilter(userID int) func(Chirp) bool {
+	return func(chirp Chirp) bool {
+		for _, mention := range chirp.Entities.Mentions {
+			if mention.UserID == userID {
+				return true
+			}
+		}
+		return false
+	}
+}